@@ -0,0 +1,268 @@
+package main
+
+import (
+	"strings"
+)
+
+func (pp *Preprocessor) isDefined(name string) bool {
+	_, ok := pp.Macros[name]
+	return ok || name == "__has_include"
+}
+
+// beginConditional opens a conditional whose first group is taken when
+// include is true.
+func (pp *Preprocessor) beginConditional(file *sourceFile, directive *Token, include bool) {
+	file.conditionals = append(file.conditionals, &conditional{
+		Directive: directive,
+		Context:   IN_THEN,
+		Included:  include,
+	})
+	if !include {
+		pp.skipGroup(file)
+	}
+}
+
+// currentConditional returns the innermost conditional of file, reporting
+// an error for directive if there is none.
+func (pp *Preprocessor) currentConditional(file *sourceFile, directive *Token) *conditional {
+	if len(file.conditionals) == 0 {
+		pp.errorAt(directive.Span, "#%s without #if", directive.Value)
+		pp.readLine(file)
+		return nil
+	}
+	cond := file.conditionals[len(file.conditionals)-1]
+	if cond.Context == IN_ELSE {
+		pp.errorAt(directive.Span, "#%s after #else", directive.Value)
+	}
+	return cond
+}
+
+func (pp *Preprocessor) elif(file *sourceFile, directive *Token) {
+	cond := pp.currentConditional(file, directive)
+	if cond == nil {
+		return
+	}
+	cond.Context = IN_ELIF
+	file.noteElse()
+	if cond.Included {
+		// a later group is not evaluated once one has been taken
+		pp.readLine(file)
+		pp.skipGroup(file)
+		return
+	}
+	if pp.condition(file, directive) {
+		cond.Included = true
+		return
+	}
+	pp.skipGroup(file)
+}
+
+func (pp *Preprocessor) elseGroup(file *sourceFile, directive *Token) {
+	cond := pp.currentConditional(file, directive)
+	if cond == nil {
+		return
+	}
+	pp.extraTokens(file, directive)
+	cond.Context = IN_ELSE
+	file.noteElse()
+	if cond.Included {
+		pp.skipGroup(file)
+		return
+	}
+	cond.Included = true
+}
+
+func (pp *Preprocessor) endif(file *sourceFile, directive *Token) {
+	if len(file.conditionals) == 0 {
+		pp.errorAt(directive.Span, "#endif without #if")
+		pp.readLine(file)
+		return
+	}
+	pp.extraTokens(file, directive)
+	file.conditionals = file.conditionals[:len(file.conditionals)-1]
+	if file.guardState == GUARD_INSIDE && len(file.conditionals) == file.guardDepth {
+		file.guardState = GUARD_END
+	}
+}
+
+func (pp *Preprocessor) extraTokens(file *sourceFile, directive *Token) {
+	if rest := pp.readLine(file); len(rest) > 0 {
+		pp.warningAt(rest[0].Span, "extra tokens at end of #%s directive", directive.Value)
+	}
+}
+
+// skipGroup skips a group that is not taken up to the #elif, #else or
+// #endif that ends it, which is then executed. Nested conditionals are
+// skipped entirely, and the text of skipped groups is not diagnosed.
+func (pp *Preprocessor) skipGroup(file *sourceFile) {
+	diagnostics := len(file.lexer.Diagnostics)
+	depth := 0
+	for {
+		token := file.next()
+		if token.Type == TK_EOF {
+			file.unread(token)
+			file.lexer.Diagnostics = file.lexer.Diagnostics[:diagnostics]
+			return
+		}
+		if token.Type != '#' || !token.AtBOL {
+			continue
+		}
+		name := file.next()
+		if name.AtBOL || name.Type == TK_EOF {
+			file.unread(name)
+			continue
+		}
+		switch name.Value {
+		case "if", "ifdef", "ifndef":
+			depth++
+		case "elif", "else":
+			if depth == 0 {
+				file.lexer.Diagnostics = file.lexer.Diagnostics[:diagnostics]
+				pp.execute(file, name)
+				return
+			}
+		case "endif":
+			if depth == 0 {
+				file.lexer.Diagnostics = file.lexer.Diagnostics[:diagnostics]
+				pp.execute(file, name)
+				return
+			}
+			depth--
+		}
+	}
+}
+
+// macroOperand reads the identifier of #ifdef or #ifndef.
+func (pp *Preprocessor) macroOperand(file *sourceFile, directive *Token) *Token {
+	line := pp.readLine(file)
+	if len(line) == 0 {
+		pp.errorAt(directive.Span, "no macro name given in #%s directive", directive.Value)
+		return nil
+	}
+	if !isIdentifierToken(line[0]) {
+		pp.errorAt(line[0].Span, "macro names must be identifiers")
+		return nil
+	}
+	if len(line) > 1 {
+		pp.warningAt(line[1].Span, "extra tokens at end of #%s directive", directive.Value)
+	}
+	return line[0]
+}
+
+// condition reads and evaluates the expression of #if or #elif.
+func (pp *Preprocessor) condition(file *sourceFile, directive *Token) bool {
+	return pp.evaluate(directive, pp.expandCondition(file, pp.readLine(file)))
+}
+
+// expandCondition macro-expands the tokens of a #if line after replacing
+// the defined and __has_include operators by 0 or 1.
+func (pp *Preprocessor) expandCondition(file *sourceFile, line []*Token) []*Token {
+	saved := pp.pending
+	pp.pending = nil
+	sentinel := &Token{Type: TK_EOF}
+	pp.unreadTokens(append(append([]*Token{}, line...), sentinel))
+	result := []*Token{}
+	for {
+		t := pp.read()
+		if t == sentinel {
+			break
+		}
+		switch {
+		case isIdentifierToken(t) && t.Value == "defined":
+			result = append(result, pp.definedOperator(t, sentinel))
+		case isIdentifierToken(t) && t.Value == "__has_include":
+			result = append(result, pp.hasInclude(file, t, sentinel))
+		case pp.expand(t):
+		default:
+			result = append(result, t)
+		}
+	}
+	pp.pending = saved
+	return result
+}
+
+// boolToken returns a number token for the result of an operator at t.
+func boolToken(t *Token, b bool) *Token {
+	value := "0"
+	if b {
+		value = "1"
+	}
+	return &Token{Span: t.Span, Type: TK_NUMBER, Value: value, Spelling: value, HasSpace: t.HasSpace}
+}
+
+func (pp *Preprocessor) definedOperator(defined *Token, sentinel *Token) *Token {
+	t := pp.read()
+	lparen := t.Type == '('
+	if lparen {
+		t = pp.read()
+	}
+	if t == sentinel || !isIdentifierToken(t) {
+		pp.unreadTokens([]*Token{t})
+		pp.errorAt(defined.Span, "operator \"defined\" requires an identifier")
+		return boolToken(defined, false)
+	}
+	if lparen {
+		if rparen := pp.read(); rparen.Type != ')' {
+			pp.unreadTokens([]*Token{rparen})
+			pp.errorAt(defined.Span, "missing ')' after \"defined\"")
+		}
+	}
+	return boolToken(defined, pp.isDefined(t.Value))
+}
+
+// hasInclude evaluates __has_include("file") or __has_include(<file>). The
+// header name may also be the result of macro expansion.
+func (pp *Preprocessor) hasInclude(file *sourceFile, operator *Token, sentinel *Token) *Token {
+	if lparen := pp.read(); lparen.Type != '(' {
+		pp.unreadTokens([]*Token{lparen})
+		pp.errorAt(operator.Span, "missing '(' after \"__has_include\"")
+		return boolToken(operator, false)
+	}
+	// the operand is expanded unless it is a header name
+	t := pp.read()
+	for t.Type != TK_STRING && t.Type != '<' && t != sentinel && pp.expand(t) {
+		t = pp.read()
+	}
+	var header string
+	quoted := t.Type == TK_STRING
+	switch {
+	case quoted && len(t.Spelling) >= 2 && t.Spelling[0] == '"':
+		header = t.Spelling[1 : len(t.Spelling)-1]
+	case t.Type == '<':
+		var b strings.Builder
+		for {
+			t = pp.read()
+			if t.Type == '>' || t == sentinel {
+				break
+			}
+			if t.HasSpace && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(t.Spelling)
+		}
+		header = b.String()
+	}
+	if header == "" || t == sentinel {
+		pp.unreadTokens([]*Token{t})
+		pp.errorAt(operator.Span, "operator \"__has_include\" requires a header name")
+		return boolToken(operator, false)
+	}
+	if rparen := pp.read(); rparen.Type != ')' {
+		pp.unreadTokens([]*Token{rparen})
+		pp.errorAt(operator.Span, "missing ')' after \"__has_include\" operand")
+	}
+	_, ok := pp.findInclude(header, quoted, file)
+	return boolToken(operator, ok)
+}
+
+// lineText spells the tokens of a directive line for #error and #warning.
+func lineText(tokens []*Token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i == 0 || t.HasSpace {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.Spelling)
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+const (
+	DIAG_ERROR = iota
+	DIAG_WARNING
+	DIAG_NOTE
+)
+
+var severityNames = map[int]string{
+	DIAG_ERROR:   "error",
+	DIAG_WARNING: "warning",
+	DIAG_NOTE:    "note",
+}
+
+// Diagnostic is a message about the source range it spans. Notes are
+// printed after it, such as the macro expansions leading to the range.
+type Diagnostic struct {
+	Span
+	Severity int
+	Message  string
+	Notes    []Diagnostic
+}
+
+func (d Diagnostic) Error() string {
+	message := fmt.Sprintf("%s: %s: %s", d.Span, severityNames[d.Severity], d.Message)
+	for _, note := range d.Notes {
+		message += "\n" + note.Error()
+	}
+	return message
+}
+
+// tokenDiagnostic returns a diagnostic at a token with an "in expansion of
+// macro" note for each expansion that produced it, innermost first.
+func tokenDiagnostic(t *Token, severity int, message string) Diagnostic {
+	d := Diagnostic{Span: t.Span, Severity: severity, Message: message}
+	for e := t.Expansion; e != nil; e = e.Parent {
+		d.Notes = append(d.Notes, Diagnostic{
+			Span:     e.Span,
+			Severity: DIAG_NOTE,
+			Message:  fmt.Sprintf("in expansion of macro '%s'", e.Macro),
+		})
+	}
+	return d
+}
+
+// hasErrors reports whether any diagnostic is an error.
+func hasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == DIAG_ERROR {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+// Resource is the data of a resource named by #embed. It stays a single
+// TK_EMBED token however large the file is, instead of one integer constant
+// per byte.
+type Resource struct {
+	Path string
+	Data []byte
+}
+
+// embedParameters are the parameters of a #embed directive. Limit is -1
+// without a limit parameter.
+type embedParameters struct {
+	Limit   int64
+	Prefix  []*Token
+	Suffix  []*Token
+	IfEmpty []*Token
+}
+
+// embed executes #embed "file" or <file>, which expands to the bytes of the
+// resource as a comma-separated list: the prefix tokens, a TK_EMBED token
+// and the suffix tokens, or only the if_empty tokens when the resource is
+// empty.
+func (pp *Preprocessor) embed(file *sourceFile, directive *Token) {
+	token := file.lexer.NextHeaderName()
+	if token.AtBOL || token.Type == TK_EOF {
+		file.unread(token)
+		pp.errorAt(directive.Span, "#embed expects \"FILENAME\" or <FILENAME>")
+		return
+	}
+	if token.Type != TK_HEADER_NAME {
+		pp.errorAt(token.Span, "#embed expects \"FILENAME\" or <FILENAME>")
+		pp.readLine(file)
+		return
+	}
+	params, ok := pp.embedParameters(file, directive, pp.readLine(file))
+	if !ok {
+		return
+	}
+	name := token.Value[1 : len(token.Value)-1]
+	path, ok := pp.findInclude(name, token.Value[0] == '"', file)
+	if !ok {
+		pp.errorAt(token.Span, "%s: No such file or directory", name)
+		return
+	}
+	data, err := readResource(path, params.Limit)
+	if err != nil {
+		pp.errorAt(token.Span, "%s: %s", name, err)
+		return
+	}
+
+	var tokens []*Token
+	if len(data) == 0 {
+		tokens = params.IfEmpty
+	} else {
+		tokens = append(tokens, params.Prefix...)
+		tokens = append(tokens, &Token{
+			Span:     token.Span,
+			Type:     TK_EMBED,
+			Value:    name,
+			Spelling: token.Value,
+			HasSpace: len(tokens) > 0,
+			Resource: &Resource{Path: path, Data: data},
+		})
+		tokens = append(tokens, params.Suffix...)
+	}
+	pp.unreadTokens(tokens)
+}
+
+// embedParameters parses the parameters following the resource name of
+// #embed. Each is a name, which may also be written __name__, and a
+// parenthesized argument.
+func (pp *Preprocessor) embedParameters(file *sourceFile, directive *Token, line []*Token) (embedParameters, bool) {
+	params := embedParameters{Limit: -1}
+	seen := map[string]bool{}
+	for i := 0; i < len(line); {
+		t := line[i]
+		if !isIdentifierToken(t) {
+			pp.errorAt(t.Span, "expected embed parameter name before \"%s\"", t.Spelling)
+			return params, false
+		}
+		name := t.Value
+		i++
+		if i+2 < len(line) && line[i].Type == ':' && line[i+1].Type == ':' && isIdentifierToken(line[i+2]) {
+			// a vendor parameter such as gnu::offset
+			name += "::" + line[i+2].Value
+			i += 3
+		}
+		if len(name) > 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__") {
+			name = name[2 : len(name)-2]
+		}
+		if name != "limit" && name != "prefix" && name != "suffix" && name != "if_empty" {
+			pp.errorAt(t.Span, "unknown embed parameter '%s'", name)
+			return params, false
+		}
+		if seen[name] {
+			pp.errorAt(t.Span, "duplicate embed parameter '%s'", name)
+			return params, false
+		}
+		seen[name] = true
+		if i >= len(line) || line[i].Type != '(' {
+			pp.errorAt(t.Span, "expected '(' after embed parameter '%s'", name)
+			return params, false
+		}
+		end := matchingParen(line, i)
+		if end < 0 {
+			pp.errorAt(line[i].Span, "unbalanced '(' in embed parameter '%s'", name)
+			return params, false
+		}
+		args := line[i+1 : end]
+		i = end + 1
+
+		switch name {
+		case "limit":
+			value, ok := pp.constantExpression(directive, pp.expandCondition(file, args))
+			if !ok {
+				return params, false
+			}
+			if !value.Unsigned && value.Value < 0 {
+				pp.errorAt(t.Span, "negative embed parameter 'limit'")
+				return params, false
+			}
+			params.Limit = value.Value
+		case "prefix":
+			params.Prefix = args
+		case "suffix":
+			params.Suffix = args
+		case "if_empty":
+			params.IfEmpty = args
+		}
+	}
+	return params, true
+}
+
+// matchingParen returns the index of the ')' closing the '(' at start, or
+// -1 if it is not closed.
+func matchingParen(tokens []*Token, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// readResource reads at most limit bytes of a resource, or all of it if
+// limit is negative.
+func readResource(path string, limit int64) ([]byte, error) {
+	f, err := openHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	return io.ReadAll(r)
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"github.com/k0kubun/pp"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const MemorySize = 8
@@ -19,14 +24,18 @@ var registerIndex = []string{
 type Generator struct {
 	//GlobalVariables  map[string]*Variable
 	//LocalVariables   map[string]*Variable
-	LabelCnt         int
-	RspCounter       int
-	CurrentLoopBegin string
-	CurrentLoopEnd   string
-	Strings          map[string]int
+	LabelCnt   int
+	RspCounter int
+	// ContinueLabels and BreakLabels are stacks of the labels continue and
+	// break jump to. A switch pushes only a break label.
+	ContinueLabels []string
+	BreakLabels    []string
+	// Function is the name of the function being generated.
+	Function string
+	Strings  []*String
 }
 
-func NewGenerator(strs map[string]int) *Generator {
+func NewGenerator(strs []*String) *Generator {
 	return &Generator{
 		//LocalVariables:  map[string]*Variable{},
 		//GlobalVariables: map[string]*Variable{},
@@ -37,19 +46,26 @@ func NewGenerator(strs map[string]int) *Generator {
 }
 
 func (g *Generator) generate(declarations []Node) {
-	for s, i := range g.Strings {
-		fmt.Printf(".LC%d:\n", i)
-		fmt.Printf("    .string \"%s\"\n", s)
-	}
-	fmt.Println(`.data
-.intel_syntax noprefix
+	fmt.Println(`.intel_syntax noprefix
 .global main`)
+	if len(g.Strings) > 0 {
+		fmt.Println(".section .rodata")
+	}
+	for _, s := range g.Strings {
+		g.generateString(s)
+	}
 	for _, declaration := range declarations {
 		declaration.Accept(g)
 	}
 }
 
 func (g *Generator) VisitInteger(n *Integer) (interface{}, error) {
+	if n.Value < math.MinInt32 || n.Value > math.MaxInt32 {
+		// push only takes a sign-extended 32-bit immediate
+		fmt.Printf("    movabs rax, %d\n", n.Value)
+		g.generatePush("rax")
+		return nil, nil
+	}
 	g.generatePush(fmt.Sprintf("%d", n.Value))
 	return nil, nil
 }
@@ -60,93 +76,302 @@ func (g *Generator) VisitChar(n *Char) (interface{}, error) {
 }
 
 func (g *Generator) VisitString(n *String) (interface{}, error) {
-	g.generatePush(fmt.Sprintf("OFFSET FLAT:.LC%d", g.Strings[n.Value]))
+	g.generatePush(fmt.Sprintf("OFFSET FLAT:.LC%d", n.Index))
 	return nil, nil
 }
 
 func (g *Generator) VisitBinaryOperator(n *BinaryOperator) (interface{}, error) {
 	switch n.Type {
-	case '+', '-', '*', '/':
-		n.Left.Accept(g)
-		if ident, ok := n.Right.(*Identifier); ok {
-			if ident.Variable.Type.Value == TYPE_PTR || ident.Variable.Type.Value == TYPE_ARRAY {
-				g.generatePop("rax")
-				fmt.Printf("    mov rdi, %d\n", ident.Variable.Type.Ptrof.Size)
-				fmt.Printf("    mul rdi\n")
-				g.generatePush("rax")
-			}
-		}
+	case '=':
+		g.generateAddress(n.Left)
 		n.Right.Accept(g)
-		if ident, ok := n.Left.(*Identifier); ok {
-			if ident.Variable.Type.Value == TYPE_PTR || ident.Variable.Type.Value == TYPE_ARRAY {
-				g.generatePop("rax")
-				fmt.Printf("    mov rdi, %d\n", ident.Variable.Type.Ptrof.Size)
-				fmt.Printf("    mul rdi\n")
-				g.generatePush("rax")
-			}
-		}
 		g.generatePop("rdi")
 		g.generatePop("rax")
-		if n.Type == '/' {
-			fmt.Printf("    mov rdx, 0\n")
-			fmt.Printf("    div rdi\n")
-		} else if n.Type == '*' {
-			fmt.Printf("    mul rdi\n")
-		} else if n.Type == '+' {
-			fmt.Printf("    add rax, rdi\n")
-		} else if n.Type == '-' {
-			fmt.Printf("    sub rax, rdi\n")
-		} else {
-			fmt.Printf("    %s rax, rdi\n", string(rune(n.Type)))
-		}
-		g.generatePush("rax")
-	case '=':
-		switch left := n.Left.(type) {
-		case *GlobalIdentifier:
-		case *Identifier:
-			fmt.Printf("    mov rax, rbp\n")
-			fmt.Printf("    sub rax, %d\n", (left.Variable.Index+1)*MemorySize)
-			g.generatePush("rax")
-		case *UnaryOperatorNode:
-			left.Accept(g)
-			g.generatePush("rax")
-		default:
-			debug(left)
-			panic("no identifier: ")
-		}
+		g.store(lvalueType(n.Left))
+		g.generatePush("rdi")
+	case ',':
+		n.Left.Accept(g)
+		g.generatePop("rax")
 		n.Right.Accept(g)
-		switch left := n.Left.(type) {
-		case *GlobalIdentifier:
-			g.generatePop("rdi")
-			fmt.Printf("    mov %s[rip], rdi\n", left.Value)
-		default:
-			g.generatePop("rdi")
-			g.generatePop("rax")
-			fmt.Printf("    mov [rax], rdi\n")
+	case ND_LOGAND, ND_LOGOR:
+		// the right operand is evaluated only if the left one does not
+		// decide the result
+		shortCircuit := fmt.Sprintf(".Lshort%04d", g.LabelCnt)
+		endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
+		g.LabelCnt++
+		jump, result := "je", 0
+		if n.Type == ND_LOGOR {
+			jump, result = "jne", 1
 		}
-		g.generatePush("rdi")
-	case ND_EQUAL:
 		n.Left.Accept(g)
+		g.generatePop("rax")
+		fmt.Printf("    cmp rax, 0\n")
+		fmt.Printf("    %s %s\n", jump, shortCircuit)
 		n.Right.Accept(g)
 		g.generatePop("rax")
-		g.generatePop("rdi")
-		fmt.Printf("    cmp rdi, rax\n")
-		fmt.Printf("    sete al\n")
-		fmt.Printf("    movzx rax, al\n")
+		fmt.Printf("    cmp rax, 0\n")
+		fmt.Printf("    %s %s\n", jump, shortCircuit)
+		fmt.Printf("    mov rax, %d\n", 1-result)
+		fmt.Printf("    jmp %s\n", endLabel)
+		fmt.Printf("%s:\n", shortCircuit)
+		fmt.Printf("    mov rax, %d\n", result)
+		fmt.Printf("%s:\n", endLabel)
 		g.generatePush("rax")
-	case ND_NOTEQUAL:
+	default:
+		// the integer added to or subtracted from a pointer counts
+		// elements, and so does the difference of two pointers
+		left, right := pointeeSize(n.Left), pointeeSize(n.Right)
 		n.Left.Accept(g)
+		if right > 0 && left == 0 && n.Type == '+' {
+			g.scale(right)
+		}
 		n.Right.Accept(g)
-		g.generatePop("rax")
+		if left > 0 && right == 0 && (n.Type == '+' || n.Type == '-') {
+			g.scale(left)
+		}
 		g.generatePop("rdi")
-		fmt.Printf("    cmp rdi, rax\n")
-		fmt.Printf("    setne al\n")
-		fmt.Printf("    movzx rax, al\n")
+		g.generatePop("rax")
+		g.arithmetic(n.Type, n.OperandType)
+		if left > 1 && right > 0 && n.Type == '-' {
+			fmt.Printf("    mov rdi, %d\n", left)
+			fmt.Printf("    cqo\n")
+			fmt.Printf("    idiv rdi\n")
+		}
 		g.generatePush("rax")
 	}
 	return nil, nil
 }
 
+// scale multiplies the value on top of the stack by the size of the
+// elements of a pointer.
+func (g *Generator) scale(size int) {
+	g.generatePop("rax")
+	fmt.Printf("    mov rdi, %d\n", size)
+	fmt.Printf("    mul rdi\n")
+	g.generatePush("rax")
+}
+
+// setcc are the set instructions of the comparison operators.
+var setcc = map[int]string{
+	ND_EQUAL:    "sete",
+	ND_NOTEQUAL: "setne",
+	'<':         "setl",
+	'>':         "setg",
+	ND_LE:       "setle",
+	ND_GE:       "setge",
+}
+
+// unsignedSetcc are the set instructions of the comparison operators on
+// unsigned operands.
+var unsignedSetcc = map[int]string{
+	ND_EQUAL:    "sete",
+	ND_NOTEQUAL: "setne",
+	'<':         "setb",
+	'>':         "seta",
+	ND_LE:       "setbe",
+	ND_GE:       "setae",
+}
+
+// arithmetic applies a binary operator to rax and rdi, leaving the result
+// in rax converted to ctype. Division and right shifts of unsigned operands
+// are unsigned, and carried out in 32 bits for unsigned int so that the
+// result is too.
+func (g *Generator) arithmetic(op int, ctype *Ctype) {
+	if _, ok := setcc[op]; ok {
+		g.compare(op, ctype)
+		return
+	}
+	unsigned := ctype != nil && ctype.Unsigned
+	unsigned32 := unsigned && ctype.Size == 4
+	switch op {
+	case '+':
+		fmt.Printf("    add rax, rdi\n")
+	case '-':
+		fmt.Printf("    sub rax, rdi\n")
+	case '*':
+		fmt.Printf("    imul rax, rdi\n")
+	case '/', '%':
+		switch {
+		case unsigned32:
+			fmt.Printf("    xor edx, edx\n")
+			fmt.Printf("    div edi\n")
+		case unsigned:
+			fmt.Printf("    xor edx, edx\n")
+			fmt.Printf("    div rdi\n")
+		default:
+			fmt.Printf("    cqo\n")
+			fmt.Printf("    idiv rdi\n")
+		}
+		if op == '%' && unsigned32 {
+			fmt.Printf("    mov eax, edx\n")
+		} else if op == '%' {
+			fmt.Printf("    mov rax, rdx\n")
+		}
+	case '&':
+		fmt.Printf("    and rax, rdi\n")
+	case '|':
+		fmt.Printf("    or rax, rdi\n")
+	case '^':
+		fmt.Printf("    xor rax, rdi\n")
+	case ND_LSHIFT, ND_RSHIFT:
+		fmt.Printf("    mov rcx, rdi\n")
+		switch {
+		case op == ND_LSHIFT:
+			fmt.Printf("    shl rax, cl\n")
+		case unsigned32:
+			fmt.Printf("    shr eax, cl\n")
+		case unsigned:
+			fmt.Printf("    shr rax, cl\n")
+		default:
+			fmt.Printf("    sar rax, cl\n")
+		}
+	}
+	if ctype != nil {
+		g.convert("rax", ctype)
+	}
+}
+
+// compare sets rax to 1 if rax and rdi, converted to ctype, satisfy the
+// comparison op and to 0 otherwise. An unknown ctype compares all 64 bits
+// as signed.
+func (g *Generator) compare(op int, ctype *Ctype) {
+	if ctype != nil && ctype.Size == 4 {
+		fmt.Printf("    cmp eax, edi\n")
+	} else {
+		fmt.Printf("    cmp rax, rdi\n")
+	}
+	if ctype != nil && ctype.Unsigned {
+		fmt.Printf("    %s al\n", unsignedSetcc[op])
+	} else {
+		fmt.Printf("    %s al\n", setcc[op])
+	}
+	fmt.Printf("    movzx rax, al\n")
+}
+
+func (g *Generator) VisitCompoundAssignment(n *CompoundAssignment) (interface{}, error) {
+	g.generateAddress(n.Left)
+	n.Right.Accept(g)
+	if size := pointeeSize(n.Left); size > 0 && (n.Type == '+' || n.Type == '-') {
+		g.scale(size)
+	}
+	g.generatePop("rsi")
+	g.generatePop("rax")
+	g.generatePush("rax")
+	g.load(lvalueType(n.Left))
+	fmt.Printf("    mov rax, rdi\n")
+	fmt.Printf("    mov rdi, rsi\n")
+	g.arithmetic(n.Type, n.OperandType)
+	fmt.Printf("    mov rdi, rax\n")
+	g.generatePop("rax")
+	g.store(lvalueType(n.Left))
+	g.generatePush("rdi")
+	return nil, nil
+}
+
+func (g *Generator) VisitConditional(n *Conditional) (interface{}, error) {
+	elseLabel := fmt.Sprintf(".Lelse%04d", g.LabelCnt)
+	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
+	g.LabelCnt++
+	n.Condition.Accept(g)
+	g.generatePop("rax")
+	fmt.Printf("    cmp rax, 0\n")
+	fmt.Printf("    je %s\n", elseLabel)
+	n.Then.Accept(g)
+	g.generatePop("rax")
+	fmt.Printf("    jmp %s\n", endLabel)
+	fmt.Printf("%s:\n", elseLabel)
+	n.Else.Accept(g)
+	g.generatePop("rax")
+	fmt.Printf("%s:\n", endLabel)
+	// the operand taken is converted to the common type of both
+	if ctype := expressionType(n); ctype != nil && !isPointer(ctype) {
+		g.convert("rax", ctype)
+	}
+	g.generatePush("rax")
+	return nil, nil
+}
+
+// generateAddress pushes the address of the lvalue n.
+func (g *Generator) generateAddress(n Node) {
+	switch n := n.(type) {
+	case *Identifier:
+		fmt.Printf("    mov rax, rbp\n")
+		fmt.Printf("    sub rax, %d\n", (n.Variable.Index+1)*MemorySize)
+		g.generatePush("rax")
+	case *GlobalIdentifier:
+		fmt.Printf("    lea rax, %s[rip]\n", n.Value)
+		g.generatePush("rax")
+	case *UnaryOperatorNode:
+		// the address of *e is the value of e
+		n.Expression.Accept(g)
+	}
+}
+
+// lvalueType returns the type of the object an lvalue designates, or nil
+// if it is not known.
+func lvalueType(n Node) *Ctype {
+	switch n := n.(type) {
+	case *Identifier:
+		return n.Variable.Type
+	case *GlobalIdentifier:
+		return n.Variable.Type
+	case *UnaryOperatorNode:
+		return pointeeType(n.Expression)
+	}
+	return nil
+}
+
+// load reads an object of type ctype at the address in rax into rdi,
+// extending it to 64 bits. An unknown type is read as 8 bytes.
+func (g *Generator) load(ctype *Ctype) {
+	switch {
+	case ctype == nil || ctype.Size == 8:
+		fmt.Printf("    mov rdi, [rax]\n")
+	case ctype.Size == 4 && ctype.Unsigned:
+		fmt.Printf("    mov edi, dword ptr [rax]\n")
+	case ctype.Size == 4:
+		fmt.Printf("    movsxd rdi, dword ptr [rax]\n")
+	case ctype.Unsigned:
+		fmt.Printf("    movzx rdi, %s ptr [rax]\n", ptrSizes[ctype.Size])
+	default:
+		fmt.Printf("    movsx rdi, %s ptr [rax]\n", ptrSizes[ctype.Size])
+	}
+}
+
+// store writes rdi as an object of type ctype to the address in rax, and
+// leaves the value stored in rdi, converted to ctype and extended to 64
+// bits. A _Bool is stored as 1 for any value other than 0.
+func (g *Generator) store(ctype *Ctype) {
+	if ctype != nil && ctype.Value == TYPE_BOOL {
+		fmt.Printf("    cmp rdi, 0\n")
+		fmt.Printf("    setne dil\n")
+		fmt.Printf("    movzx rdi, dil\n")
+	}
+	if ctype == nil || ctype.Size == 8 {
+		fmt.Printf("    mov [rax], rdi\n")
+		return
+	}
+	fmt.Printf("    mov %s ptr [rax], %s\n", ptrSizes[ctype.Size], registerParts["rdi"][ctype.Size])
+	g.convert("rdi", ctype)
+}
+
+// convert converts the value in a 64-bit register to an integer type
+// narrower than 8 bytes, sign- or zero-extending it from its width.
+func (g *Generator) convert(register string, ctype *Ctype) {
+	part, ok := registerParts[register][ctype.Size]
+	switch {
+	case !ok:
+	case ctype.Size == 4 && ctype.Unsigned:
+		fmt.Printf("    mov %s, %s\n", part, part)
+	case ctype.Size == 4:
+		fmt.Printf("    movsxd %s, %s\n", register, part)
+	case ctype.Unsigned:
+		fmt.Printf("    movzx %s, %s\n", register, part)
+	default:
+		fmt.Printf("    movsx %s, %s\n", register, part)
+	}
+}
+
 func (g *Generator) VisitReturn(n *Return) (interface{}, error) {
 	n.Expression.Accept(g)
 	g.generatePop("rax")
@@ -158,7 +383,9 @@ func (g *Generator) VisitReturn(n *Return) (interface{}, error) {
 
 func (g *Generator) VisitFunction(n *Function) (interface{}, error) {
 	fmt.Printf("\n")
+	fmt.Printf(".text\n")
 	fmt.Printf("%s:\n", n.Identifier)
+	g.Function = n.Identifier
 	g.generatePush("rbp")
 	fmt.Printf("    mov rbp, rsp\n")
 
@@ -185,7 +412,8 @@ func (g *Generator) VisitIdentifier(n *Identifier) (interface{}, error) {
 	if n.Variable.Type.Value == TYPE_ARRAY {
 		g.generatePush("rax")
 	} else {
-		g.generatePush("[rax]")
+		g.load(n.Variable.Type)
+		g.generatePush("rdi")
 	}
 	return nil, nil
 }
@@ -226,79 +454,282 @@ func (g *Generator) VisitCall(n *Call) (interface{}, error) {
 	return nil, nil
 }
 
+// VisitIf emits the statement taken as a branch to an else label, and the
+// other as the fall-through to the end label. Like every statement, it
+// leaves one value on the stack.
 func (g *Generator) VisitIf(n *If) (interface{}, error) {
+	elseLabel := fmt.Sprintf(".Lelse%04d", g.LabelCnt)
+	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
+	g.LabelCnt++
 	n.Expression.Accept(g)
-	label := fmt.Sprintf(".Lend%04d", g.LabelCnt)
 	g.generatePop("rax")
 	fmt.Printf("    cmp rax, 0\n")
-	fmt.Printf("    je %s\n", label)
-	g.LabelCnt++
+	fmt.Printf("    je %s\n", elseLabel)
 	n.IfStatements.Accept(g)
-	fmt.Printf("%s:\n", label)
+	g.generatePop("rax")
+	fmt.Printf("    jmp %s\n", endLabel)
+	fmt.Printf("%s:\n", elseLabel)
+	if n.ElseStatements != nil {
+		n.ElseStatements.Accept(g)
+		g.generatePop("rax")
+	}
+	fmt.Printf("%s:\n", endLabel)
+	g.generatePush("rax")
 	return nil, nil
 }
 
+func (g *Generator) pushLoop(continueLabel string, breakLabel string) {
+	g.ContinueLabels = append(g.ContinueLabels, continueLabel)
+	g.BreakLabels = append(g.BreakLabels, breakLabel)
+}
+
+func (g *Generator) popLoop() {
+	g.ContinueLabels = g.ContinueLabels[:len(g.ContinueLabels)-1]
+	g.BreakLabels = g.BreakLabels[:len(g.BreakLabels)-1]
+}
+
 func (g *Generator) VisitFor(n *For) (interface{}, error) {
 	beginLabel := fmt.Sprintf(".Lbegin%04d", g.LabelCnt)
+	continueLabel := fmt.Sprintf(".Lcontinue%04d", g.LabelCnt)
 	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
-	oldBegin := g.CurrentLoopBegin
-	oldEnd := g.CurrentLoopEnd
-	g.CurrentLoopBegin = beginLabel
-	g.CurrentLoopEnd = endLabel
 	g.LabelCnt++
+	g.pushLoop(continueLabel, endLabel)
 
-	n.Init.Accept(g)
+	if n.Init != nil {
+		n.Init.Accept(g)
+		g.generatePop("rax")
+	}
+	fmt.Printf("%s:\n", beginLabel)
+	if n.Expression != nil {
+		n.Expression.Accept(g)
+		g.generatePop("rax")
+		fmt.Printf("    cmp rax, 0\n")
+		fmt.Printf("    je %s\n", endLabel)
+	}
+	n.Statements.Accept(g)
 	g.generatePop("rax")
+	// continue runs the update before the condition is tested again
+	fmt.Printf("%s:\n", continueLabel)
+	if n.Update != nil {
+		n.Update.Accept(g)
+		g.generatePop("rax")
+	}
+	fmt.Printf("jmp %s\n", beginLabel)
+	fmt.Printf("%s:\n", endLabel)
+
+	g.popLoop()
+	g.generatePush("rax")
+	return nil, nil
+}
+
+func (g *Generator) VisitWhile(n *While) (interface{}, error) {
+	beginLabel := fmt.Sprintf(".Lbegin%04d", g.LabelCnt)
+	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
+	g.LabelCnt++
+	g.pushLoop(beginLabel, endLabel)
+
 	fmt.Printf("%s:\n", beginLabel)
 	n.Expression.Accept(g)
 	g.generatePop("rax")
 	fmt.Printf("    cmp rax, 0\n")
 	fmt.Printf("    je %s\n", endLabel)
 	n.Statements.Accept(g)
-	n.Update.Accept(g)
 	g.generatePop("rax")
 	fmt.Printf("jmp %s\n", beginLabel)
 	fmt.Printf("%s:\n", endLabel)
-
-	g.CurrentLoopBegin = oldBegin
-	g.CurrentLoopEnd = oldEnd
+	g.popLoop()
+	g.generatePush("rax")
 	return nil, nil
 }
 
-func (g *Generator) VisitWhile(n *While) (interface{}, error) {
+func (g *Generator) VisitDoWhile(n *DoWhile) (interface{}, error) {
 	beginLabel := fmt.Sprintf(".Lbegin%04d", g.LabelCnt)
+	continueLabel := fmt.Sprintf(".Lcontinue%04d", g.LabelCnt)
 	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
-	oldBegin := g.CurrentLoopBegin
-	oldEnd := g.CurrentLoopEnd
-	g.CurrentLoopBegin = beginLabel
-	g.CurrentLoopEnd = endLabel
 	g.LabelCnt++
+	g.pushLoop(continueLabel, endLabel)
 
 	fmt.Printf("%s:\n", beginLabel)
+	n.Statements.Accept(g)
+	g.generatePop("rax")
+	fmt.Printf("%s:\n", continueLabel)
 	n.Expression.Accept(g)
 	g.generatePop("rax")
 	fmt.Printf("    cmp rax, 0\n")
-	fmt.Printf("    je %s\n", endLabel)
+	fmt.Printf("    jne %s\n", beginLabel)
+	fmt.Printf("%s:\n", endLabel)
+	g.popLoop()
+	g.generatePush("rax")
+	return nil, nil
+}
+
+// A switch with fewer cases than SWITCH_CHAIN_CASES compares against each
+// case in turn. A denser one, with at least one case in every
+// SWITCH_TABLE_DENSITY values, jumps through a table; any other switch
+// finds the case by binary search.
+const (
+	SWITCH_CHAIN_CASES   = 4
+	SWITCH_TABLE_DENSITY = 3
+	SWITCH_TABLE_MAX     = 4096
+)
+
+func (g *Generator) VisitSwitch(n *Switch) (interface{}, error) {
+	endLabel := fmt.Sprintf(".Lend%04d", g.LabelCnt)
+	g.LabelCnt++
+	unsigned := n.Ctype != nil && n.Ctype.Unsigned
+	cases := make([]*Case, len(n.Cases))
+	copy(cases, n.Cases)
+	sort.Slice(cases, func(i, j int) bool {
+		if unsigned {
+			return uint64(cases[i].Value) < uint64(cases[j].Value)
+		}
+		return cases[i].Value < cases[j].Value
+	})
+	for _, c := range cases {
+		c.Label = fmt.Sprintf(".Lcase%04d", g.LabelCnt)
+		g.LabelCnt++
+	}
+	defaultLabel := endLabel
+	if n.Default != nil {
+		n.Default.Label = fmt.Sprintf(".Ldefault%04d", g.LabelCnt)
+		g.LabelCnt++
+		defaultLabel = n.Default.Label
+	}
+
+	n.Expression.Accept(g)
+	g.generatePop("rax")
+	// the cases compare all 64 bits of the promoted value
+	if n.Ctype != nil {
+		g.convert("rax", n.Ctype)
+	}
+	if len(cases) > 0 {
+		span := cases[len(cases)-1].Value - cases[0].Value + 1
+		switch {
+		case len(cases) < SWITCH_CHAIN_CASES:
+			g.compareChain(cases)
+		case span > 0 && span <= len(cases)*SWITCH_TABLE_DENSITY && span <= SWITCH_TABLE_MAX:
+			g.jumpTable(cases, defaultLabel)
+		default:
+			g.binarySearch(cases, unsigned, defaultLabel)
+		}
+	}
+	fmt.Printf("    jmp %s\n", defaultLabel)
+
+	g.BreakLabels = append(g.BreakLabels, endLabel)
 	n.Statements.Accept(g)
-	fmt.Printf("jmp %s\n", beginLabel)
+	g.generatePop("rax")
+	g.BreakLabels = g.BreakLabels[:len(g.BreakLabels)-1]
 	fmt.Printf("%s:\n", endLabel)
-	g.CurrentLoopBegin = oldBegin
-	g.CurrentLoopEnd = oldEnd
 	g.generatePush("rax")
 	return nil, nil
 }
 
+func (g *Generator) VisitCase(n *Case) (interface{}, error) {
+	fmt.Printf("%s:\n", n.Label)
+	n.Statement.Accept(g)
+	return nil, nil
+}
+
+// compareCase compares the switch value in rax with a case value.
+func (g *Generator) compareCase(value int) {
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		fmt.Printf("    mov rdi, %d\n", value)
+		fmt.Printf("    cmp rax, rdi\n")
+		return
+	}
+	fmt.Printf("    cmp rax, %d\n", value)
+}
+
+// compareChain jumps to the case equal to rax, trying each in turn.
+func (g *Generator) compareChain(cases []*Case) {
+	for _, c := range cases {
+		g.compareCase(c.Value)
+		fmt.Printf("    je %s\n", c.Label)
+	}
+}
+
+// jumpTable jumps through a table in .rodata indexed by rax less the
+// smallest case value. The values missing between the cases go to the
+// default label.
+func (g *Generator) jumpTable(cases []*Case, defaultLabel string) {
+	table := fmt.Sprintf(".Ltable%04d", g.LabelCnt)
+	g.LabelCnt++
+	low := cases[0].Value
+	span := cases[len(cases)-1].Value - low + 1
+	if low != 0 {
+		fmt.Printf("    mov rdi, %d\n", low)
+		fmt.Printf("    sub rax, rdi\n")
+	}
+	// a value below the smallest case wraps around to a large index
+	fmt.Printf("    cmp rax, %d\n", span-1)
+	fmt.Printf("    ja %s\n", defaultLabel)
+	fmt.Printf("    lea rdi, [rip + %s]\n", table)
+	fmt.Printf("    jmp [rdi + rax*8]\n")
+
+	fmt.Printf(".section .rodata\n")
+	fmt.Printf("    .align 8\n")
+	fmt.Printf("%s:\n", table)
+	next := 0
+	for v := low; v < low+span; v++ {
+		if cases[next].Value == v {
+			fmt.Printf("    .quad %s\n", cases[next].Label)
+			next++
+		} else {
+			fmt.Printf("    .quad %s\n", defaultLabel)
+		}
+	}
+	fmt.Printf(".text\n")
+}
+
+// binarySearch finds the case equal to rax among cases sorted by value,
+// comparing a middle case and going on in the half that can still match.
+// Few enough cases are compared in turn.
+func (g *Generator) binarySearch(cases []*Case, unsigned bool, defaultLabel string) {
+	if len(cases) < SWITCH_CHAIN_CASES {
+		g.compareChain(cases)
+		fmt.Printf("    jmp %s\n", defaultLabel)
+		return
+	}
+	upperLabel := fmt.Sprintf(".Lupper%04d", g.LabelCnt)
+	g.LabelCnt++
+	mid := len(cases) / 2
+	g.compareCase(cases[mid].Value)
+	fmt.Printf("    je %s\n", cases[mid].Label)
+	if unsigned {
+		fmt.Printf("    ja %s\n", upperLabel)
+	} else {
+		fmt.Printf("    jg %s\n", upperLabel)
+	}
+	g.binarySearch(cases[:mid], unsigned, defaultLabel)
+	fmt.Printf("%s:\n", upperLabel)
+	g.binarySearch(cases[mid+1:], unsigned, defaultLabel)
+}
+
 func (g *Generator) VisitGoto(n *Goto) (interface{}, error) {
+	fmt.Printf("jmp %s\n", g.userLabel(n.Label))
 	return nil, nil
 }
 
+func (g *Generator) VisitLabeledStatement(n *LabeledStatement) (interface{}, error) {
+	fmt.Printf("%s:\n", g.userLabel(n.Label))
+	n.Statement.Accept(g)
+	return nil, nil
+}
+
+// userLabel returns the assembly label of a label of the current function.
+// Every statement leaves the stack as it found it, so a goto may jump
+// between any two of them.
+func (g *Generator) userLabel(name string) string {
+	return fmt.Sprintf(".Llabel.%s.%s", g.Function, name)
+}
+
 func (g *Generator) VisitContinue(n *Continue) (interface{}, error) {
-	fmt.Printf("jmp %s\n", g.CurrentLoopBegin)
+	fmt.Printf("jmp %s\n", g.ContinueLabels[len(g.ContinueLabels)-1])
 	return nil, nil
 }
 
 func (g *Generator) VisitBreak(n *Break) (interface{}, error) {
-	fmt.Printf("jmp %s\n", g.CurrentLoopEnd)
+	fmt.Printf("jmp %s\n", g.BreakLabels[len(g.BreakLabels)-1])
 	return nil, nil
 }
 
@@ -307,12 +738,14 @@ func (g *Generator) VisitBlock(n *Block) (interface{}, error) {
 		stmt.Accept(g)
 		g.generatePop("rax")
 	}
+	g.generatePush("rax")
 	return nil, nil
 }
 
 func (g *Generator) VisitVariableDeclaration(n *VariableDeclaration) (interface{}, error) {
-	g.generatePush("rax") // TODO: delete
-	if n.Expression != nil {
+	if n.Expression == nil {
+		g.generatePush("rax")
+	} else {
 		//if n.Type.Value == TYPE_ARRAY {
 		//	v := g.LocalVariables[n.Identifier]
 		//	fmt.Printf("    mov rax, rbp\n")
@@ -325,7 +758,7 @@ func (g *Generator) VisitVariableDeclaration(n *VariableDeclaration) (interface{
 		n.Expression.Accept(g)
 		g.generatePop("rdi")
 		g.generatePop("rax")
-		fmt.Printf("    mov [rax], rdi\n")
+		g.store(n.Variable.Type)
 		g.generatePush("rdi")
 	}
 	return nil, nil
@@ -336,41 +769,201 @@ func (g *Generator) VisitUnaryOperator(n *UnaryOperatorNode) (interface{}, error
 	case '*':
 		n.Expression.Accept(g)
 		g.generatePop("rax")
-		g.generatePush("[rax]")
+		g.load(pointeeType(n.Expression))
+		g.generatePush("rdi")
 	case '&':
-		if ident, ok := n.Expression.(*Identifier); ok {
-			fmt.Printf("    mov rax, rbp\n")
-			fmt.Printf("    sub rax, %d\n", (ident.Variable.Index+1)*MemorySize)
-			g.generatePush("rax")
-		} else if _, ok := n.Expression.(*GlobalIdentifier); ok {
-			panic("not impl")
+		g.generateAddress(n.Expression)
+	case '~':
+		n.Expression.Accept(g)
+		g.generatePop("rax")
+		fmt.Printf("    not rax\n")
+		if ctype := expressionType(n); ctype != nil {
+			g.convert("rax", ctype)
+		}
+		g.generatePush("rax")
+	case '!':
+		n.Expression.Accept(g)
+		g.generatePop("rax")
+		fmt.Printf("    cmp rax, 0\n")
+		fmt.Printf("    sete al\n")
+		fmt.Printf("    movzx rax, al\n")
+		g.generatePush("rax")
+	case ND_POSTINC, ND_POSTDEC:
+		// the result is the value before the update
+		step := 1
+		if size := pointeeSize(n.Expression); size > 0 {
+			step = size
+		}
+		if n.Type == ND_POSTDEC {
+			step = -step
 		}
+		ctype := lvalueType(n.Expression)
+		g.generateAddress(n.Expression)
+		g.generatePop("rax")
+		g.load(ctype)
+		g.generatePush("rdi")
+		fmt.Printf("    add rdi, %d\n", step)
+		g.store(ctype)
 	}
 	return nil, nil
 }
 
 func (g *Generator) VisitGlobalIdentifier(n *GlobalIdentifier) (interface{}, error) {
-	fmt.Printf("    mov rax, %s[rip]\n", n.Value)
-	g.generatePush("rax")
+	fmt.Printf("    lea rax, %s[rip]\n", n.Value)
+	if n.Variable.Type.Value == TYPE_ARRAY {
+		g.generatePush("rax")
+	} else {
+		g.load(n.Variable.Type)
+		g.generatePush("rdi")
+	}
 	return nil, nil
 }
 
+var ptrSizes = map[int]string{
+	1: "byte",
+	2: "word",
+	4: "dword",
+}
+
+// registerParts are the names of the low 1, 2 and 4 bytes of registers.
+var registerParts = map[string]map[int]string{
+	"rax": {1: "al", 2: "ax", 4: "eax"},
+	"rdi": {1: "dil", 2: "di", 4: "edi"},
+}
+
+// pointeeType returns the type an address computed by n points to, or nil
+// if it is not known.
+func pointeeType(n Node) *Ctype {
+	if ctype := expressionType(n); isPointer(ctype) {
+		return ctype.Ptrof
+	}
+	return nil
+}
+
+// pointeeSize returns the size of the elements a pointer or array operand
+// points to, which scales the other operand of + and -, or 0 for other
+// operands.
+func pointeeSize(n Node) int {
+	if ctype := pointeeType(n); ctype != nil {
+		return ctype.Size
+	}
+	return 0
+}
+
 func (g *Generator) VisitGlobalVariableDeclaration(n *GlobalVariableDeclaration) (interface{}, error) {
+	fmt.Printf(".data\n")
+	if n.Align > 0 {
+		fmt.Printf("    .align %d\n", n.Align)
+	}
 	fmt.Printf("%s:\n", n.Identifier)
-	if n.Expression != nil {
-		switch n.Type.Value {
-		case TYPE_INT:
-			switch node := n.Expression.(type) {
-			case *Integer:
-				fmt.Printf("    .long %d\n", node.Value)
-				return nil, nil
-			}
+	if list, ok := n.Expression.(*InitializerList); ok {
+		return list.Accept(g)
+	}
+	if node, ok := n.Expression.(*Integer); ok {
+		fmt.Printf("    %s %d\n", dataDirectives[n.Type.Size], n.Type.convert(node.Value))
+		return nil, nil
+	}
+	fmt.Printf("    .zero %d\n", n.Type.Size)
+	return nil, nil
+}
+
+// dataDirectives are the directives that emit an integer of each size.
+var dataDirectives = map[int]string{
+	1: ".byte",
+	2: ".short",
+	4: ".long",
+	8: ".quad",
+}
+
+func (g *Generator) VisitInitializerList(n *InitializerList) (interface{}, error) {
+	element := n.Ctype.Ptrof
+	count := 0
+	for _, e := range n.Elements {
+		switch e := e.(type) {
+		case *Embed:
+			e.Accept(g)
+			count += len(e.Resource.Data)
+		case *Integer:
+			fmt.Printf("    %s %d\n", dataDirectives[element.Size], element.convert(e.Value))
+			count++
 		}
 	}
-	fmt.Printf("    .text %d\n", n.Type.Size)
+	if count < n.Ctype.ArraySize {
+		fmt.Printf("    .zero %d\n", (n.Ctype.ArraySize-count)*element.Size)
+	}
 	return nil, nil
 }
 
+// VisitEmbed emits the elements initialized by a #embed resource. A char
+// array takes the file as it is with .incbin; wider elements, and built-in
+// headers which are not on disk, get a directive per line of 16 bytes.
+func (g *Generator) VisitEmbed(n *Embed) (interface{}, error) {
+	data := n.Resource.Data
+	if n.Ctype.Size == 1 && !isBuiltinHeader(n.Resource.Path) {
+		path, err := filepath.Abs(n.Resource.Path)
+		if err != nil {
+			path = n.Resource.Path
+		}
+		fmt.Printf("    .incbin \"%s\", 0, %d\n", escapeAsmString(path), len(data))
+		return nil, nil
+	}
+	for start := 0; start < len(data); start += 16 {
+		end := start + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		values := make([]string, 0, end-start)
+		for _, b := range data[start:end] {
+			values = append(values, strconv.Itoa(int(b)))
+		}
+		fmt.Printf("    %s %s\n", dataDirectives[n.Ctype.Size], strings.Join(values, ","))
+	}
+	return nil, nil
+}
+
+// generateString emits the data of a string literal. Narrow strings use
+// .string; wide ones list their code units with a directive of the element
+// width, followed by the terminator.
+func (g *Generator) generateString(n *String) {
+	if n.Ctype.Size == 1 {
+		fmt.Printf(".LC%d:\n", n.Index)
+		fmt.Printf("    .string \"%s\"\n", escapeAsmString(n.Value))
+		return
+	}
+	directive := ".long"
+	if n.Ctype.Size == 2 {
+		directive = ".short"
+	}
+	values := make([]string, 0, len(n.Chars)+1)
+	for _, c := range n.Chars {
+		values = append(values, fmt.Sprintf("%d", c.Value))
+	}
+	values = append(values, "0")
+	fmt.Printf("    .align %d\n", n.Ctype.Size)
+	fmt.Printf(".LC%d:\n", n.Index)
+	fmt.Printf("    %s %s\n", directive, strings.Join(values, ", "))
+}
+
+// escapeAsmString quotes s for a .string directive. Quotes and backslashes
+// are escaped and bytes outside printable ASCII are written as octal escapes,
+// so arbitrary byte sequences survive the assembler unchanged.
+func escapeAsmString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7F:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	return b.String()
+}
+
 func (g *Generator) generatePush(register string) {
 	g.RspCounter += 8
 	fmt.Printf("    push %s\n", register)
@@ -1,6 +1,6 @@
 module github.com/tzmfreedom/mycc
 
-go 1.12
+go 1.16
 
 require (
 	github.com/k0kubun/pp v3.0.1+incompatible
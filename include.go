@@ -0,0 +1,47 @@
+package main
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// builtinHeaders are the freestanding headers shipped inside mycc. Their
+// types and limits follow the sizes of the Ctypes in node.go.
+//
+//go:embed include/*.h
+var builtinHeaders embed.FS
+
+// BuiltinIncludeDir is the directory the built-in headers appear in. It is
+// searched after -isystem and before the default system directories.
+const BuiltinIncludeDir = "<mycc>/include"
+
+func isBuiltinHeader(path string) bool {
+	return strings.HasPrefix(path, BuiltinIncludeDir+"/")
+}
+
+// headerExists reports whether path names a built-in header or a file.
+func headerExists(path string) bool {
+	var info fs.FileInfo
+	var err error
+	if isBuiltinHeader(path) {
+		info, err = fs.Stat(builtinHeaders, builtinName(path))
+	} else {
+		info, err = os.Stat(path)
+	}
+	return err == nil && !info.IsDir()
+}
+
+func openHeader(path string) (io.ReadCloser, error) {
+	if isBuiltinHeader(path) {
+		return builtinHeaders.Open(builtinName(path))
+	}
+	return os.Open(path)
+}
+
+// builtinName returns the name of a built-in header in builtinHeaders.
+func builtinName(path string) string {
+	return "include/" + strings.TrimPrefix(path, BuiltinIncludeDir+"/")
+}
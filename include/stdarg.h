@@ -0,0 +1,8 @@
+#ifndef __STDARG_H
+#define __STDARG_H
+
+// mycc does not support variadic functions yet. va_list and the va_
+// macros need the compiler to know the register save area of a function,
+// so they are left out rather than defined in terms of GCC builtins.
+
+#endif
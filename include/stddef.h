@@ -0,0 +1,12 @@
+#ifndef __STDDEF_H
+#define __STDDEF_H
+
+typedef unsigned long size_t;
+typedef long ptrdiff_t;
+typedef int wchar_t;
+
+// mycc has neither casts nor structs yet, so NULL is the plain null
+// pointer constant 0, and max_align_t and offsetof are not provided.
+#define NULL 0
+
+#endif
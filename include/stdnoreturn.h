@@ -0,0 +1,6 @@
+#ifndef __STDNORETURN_H
+#define __STDNORETURN_H
+
+#define noreturn _Noreturn
+
+#endif
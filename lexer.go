@@ -1,152 +1,711 @@
 package main
 
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
 const (
 	TK_NUMBER = iota + 256
-	TK_CHAR
+	TK_CHARACTER
 	TK_STRING
 	TK_IDENT
 	TK_EOF
-	TK_RETURN
+	TK_HEADER_NAME
+	TK_PRAGMA
+	TK_EMBED
 	TK_EQUAL
 	TK_NOTEQUAL
-	TK_IF
+	TK_ARROW
+	TK_INC
+	TK_DEC
+	TK_LSHIFT
+	TK_RSHIFT
+	TK_LE
+	TK_GE
+	TK_LOGAND
+	TK_LOGOR
+	TK_ELLIPSIS
+	TK_MUL_ASSIGN
+	TK_DIV_ASSIGN
+	TK_MOD_ASSIGN
+	TK_ADD_ASSIGN
+	TK_SUB_ASSIGN
+	TK_LSHIFT_ASSIGN
+	TK_RSHIFT_ASSIGN
+	TK_AND_ASSIGN
+	TK_XOR_ASSIGN
+	TK_OR_ASSIGN
+	TK_HASHHASH
+	TK_AUTO
+	TK_BREAK
+	TK_CASE
+	TK_CHAR
+	TK_CONST
+	TK_CONTINUE
+	TK_DEFAULT
+	TK_DO
+	TK_DOUBLE
 	TK_ELSE
+	TK_ENUM
+	TK_EXTERN
+	TK_FLOAT
 	TK_FOR
-	TK_WHILE
 	TK_GOTO
-	TK_BREAK
-	TK_CONTINUE
+	TK_IF
+	TK_INLINE
+	TK_INT
+	TK_LONG
+	TK_REGISTER
+	TK_RESTRICT
+	TK_RETURN
+	TK_SHORT
+	TK_SIGNED
 	TK_SIZEOF
+	TK_STATIC
+	TK_STRUCT
+	TK_SWITCH
+	TK_TYPEDEF
+	TK_UNION
+	TK_UNSIGNED
+	TK_VOID
+	TK_VOLATILE
+	TK_WHILE
+	TK_ALIGNAS
+	TK_ALIGNOF
+	TK_ATOMIC
+	TK_BOOL
+	TK_COMPLEX
+	TK_GENERIC
+	TK_IMAGINARY
+	TK_NORETURN
+	TK_STATIC_ASSERT
+	TK_THREAD_LOCAL
 )
 
+// reservationTypes maps every C11 keyword to its token type.
 var reservationTypes = map[string]int{
-	"return":   TK_RETURN,
-	"if":       TK_IF,
-	"else":     TK_ELSE,
-	"for":      TK_FOR,
-	"while":    TK_WHILE,
-	"goto":     TK_GOTO,
-	"break":    TK_BREAK,
-	"continue": TK_CONTINUE,
-	"sizeof":   TK_SIZEOF,
+	"auto":           TK_AUTO,
+	"break":          TK_BREAK,
+	"case":           TK_CASE,
+	"char":           TK_CHAR,
+	"const":          TK_CONST,
+	"continue":       TK_CONTINUE,
+	"default":        TK_DEFAULT,
+	"do":             TK_DO,
+	"double":         TK_DOUBLE,
+	"else":           TK_ELSE,
+	"enum":           TK_ENUM,
+	"extern":         TK_EXTERN,
+	"float":          TK_FLOAT,
+	"for":            TK_FOR,
+	"goto":           TK_GOTO,
+	"if":             TK_IF,
+	"inline":         TK_INLINE,
+	"int":            TK_INT,
+	"long":           TK_LONG,
+	"register":       TK_REGISTER,
+	"restrict":       TK_RESTRICT,
+	"return":         TK_RETURN,
+	"short":          TK_SHORT,
+	"signed":         TK_SIGNED,
+	"sizeof":         TK_SIZEOF,
+	"static":         TK_STATIC,
+	"struct":         TK_STRUCT,
+	"switch":         TK_SWITCH,
+	"typedef":        TK_TYPEDEF,
+	"union":          TK_UNION,
+	"unsigned":       TK_UNSIGNED,
+	"void":           TK_VOID,
+	"volatile":       TK_VOLATILE,
+	"while":          TK_WHILE,
+	"_Alignas":       TK_ALIGNAS,
+	"_Alignof":       TK_ALIGNOF,
+	"_Atomic":        TK_ATOMIC,
+	"_Bool":          TK_BOOL,
+	"_Complex":       TK_COMPLEX,
+	"_Generic":       TK_GENERIC,
+	"_Imaginary":     TK_IMAGINARY,
+	"_Noreturn":      TK_NORETURN,
+	"_Static_assert": TK_STATIC_ASSERT,
+	"_Thread_local":  TK_THREAD_LOCAL,
+}
+
+// punctuators lists every C11 punctuator, longest spelling first so that
+// the lexer always takes the longest match. Digraphs map to the token type
+// of the punctuator they stand for.
+var punctuators = []struct {
+	Value string
+	Type  int
+}{
+	{"%:%:", TK_HASHHASH},
+	{"...", TK_ELLIPSIS},
+	{"<<=", TK_LSHIFT_ASSIGN},
+	{">>=", TK_RSHIFT_ASSIGN},
+	{"->", TK_ARROW},
+	{"++", TK_INC},
+	{"--", TK_DEC},
+	{"<<", TK_LSHIFT},
+	{">>", TK_RSHIFT},
+	{"<=", TK_LE},
+	{">=", TK_GE},
+	{"==", TK_EQUAL},
+	{"!=", TK_NOTEQUAL},
+	{"&&", TK_LOGAND},
+	{"||", TK_LOGOR},
+	{"*=", TK_MUL_ASSIGN},
+	{"/=", TK_DIV_ASSIGN},
+	{"%=", TK_MOD_ASSIGN},
+	{"+=", TK_ADD_ASSIGN},
+	{"-=", TK_SUB_ASSIGN},
+	{"&=", TK_AND_ASSIGN},
+	{"^=", TK_XOR_ASSIGN},
+	{"|=", TK_OR_ASSIGN},
+	{"##", TK_HASHHASH},
+	{"<:", '['},
+	{":>", ']'},
+	{"<%", '{'},
+	{"%>", '}'},
+	{"%:", '#'},
+	{"[", '['},
+	{"]", ']'},
+	{"(", '('},
+	{")", ')'},
+	{"{", '{'},
+	{"}", '}'},
+	{".", '.'},
+	{"&", '&'},
+	{"*", '*'},
+	{"+", '+'},
+	{"-", '-'},
+	{"~", '~'},
+	{"!", '!'},
+	{"/", '/'},
+	{"%", '%'},
+	{"<", '<'},
+	{">", '>'},
+	{"^", '^'},
+	{"|", '|'},
+	{"?", '?'},
+	{":", ':'},
+	{";", ';'},
+	{"=", '='},
+	{",", ','},
+	{"#", '#'},
+}
+
+// TabStop is the column width a tab advances to when computing columns.
+const TabStop = 8
+
+// Span is the source range of a token or node. Offset is the byte offset of
+// the first character; EndOffset, EndLine and EndColumn point just past the
+// last one. Lines and columns start at 1.
+type Span struct {
+	File      string
+	Offset    int
+	Line      int
+	Column    int
+	EndOffset int
+	EndLine   int
+	EndColumn int
 }
 
+func (s Span) SourceSpan() Span {
+	return s
+}
+
+func (s Span) String() string {
+	if s.Line == 0 {
+		return s.File
+	}
+	return fmt.Sprintf("%s:%d:%d", s.File, s.Line, s.Column)
+}
+
+// joinSpan returns the range covering both from and to.
+func joinSpan(from Span, to Span) Span {
+	if from.File != to.File || to.EndOffset < from.Offset {
+		// the tokens come from different files or macro definitions
+		return from
+	}
+	from.EndOffset = to.EndOffset
+	from.EndLine = to.EndLine
+	from.EndColumn = to.EndColumn
+	return from
+}
+
+// Encoding prefixes of character constants and string literals.
+const (
+	ENC_NONE  = iota
+	ENC_UTF8  // u8
+	ENC_UTF16 // u
+	ENC_UTF32 // U
+	ENC_WCHAR // L
+)
+
+var encodingPrefixes = []struct {
+	Value    string
+	Encoding int
+}{
+	{"u8", ENC_UTF8},
+	{"u", ENC_UTF16},
+	{"U", ENC_UTF32},
+	{"L", ENC_WCHAR},
+}
+
+// encodingSize returns the size in bytes of one code unit of an encoding.
+func encodingSize(encoding int) int {
+	switch encoding {
+	case ENC_UTF16:
+		return 2
+	case ENC_UTF32, ENC_WCHAR:
+		return 4
+	}
+	return 1
+}
+
+// Token is a lexical token. For character constants and string literals
+// Value holds the decoded code units in little-endian byte order, i.e. the
+// object representation of the literal without its terminator, and Encoding
+// tells how wide each unit is. Spelling is the token as written in the
+// source. AtBOL and HasSpace record whether the token starts a line or
+// follows whitespace, and HideSet names the macros that must not expand it
+// again; the preprocessor relies on these.
 type Token struct {
-	Type    int
-	Value   string
-	PtrSize int
-	Line    int
-	Column  int
+	Span
+	Type     int
+	Value    string
+	Spelling string
+	PtrSize  int
+	Encoding int
+	AtBOL    bool
+	HasSpace bool
+	HideSet  HideSet
+	// Resource holds the bytes of a TK_EMBED token.
+	Resource *Resource
+	// Expansion is the innermost macro expansion that produced the token,
+	// nil for a token that is written where it is used.
+	Expansion *Expansion
 }
 
+// Location returns where a token is used in the source: the outermost use
+// of the macros it was expanded from, or else its own span.
+func (t *Token) Location() Span {
+	if t.Expansion == nil {
+		return t.Span
+	}
+	e := t.Expansion
+	for e.Parent != nil {
+		e = e.Parent
+	}
+	return e.Span
+}
+
+func (t *Token) copy() *Token {
+	c := *t
+	return &c
+}
+
+// maxLookahead is the number of runes the lexer can see ahead of its
+// position, enough for the longest punctuator "%:%:".
+const maxLookahead = 4
+
+type lookaheadRune struct {
+	r    rune
+	size int
+}
+
+// Lexer reads source runes on demand from an io.Reader, so only a bounded
+// lookahead window of the input is held in memory at any time.
 type Lexer struct {
-	Original string
-	Runes    []rune
-	Index    int
-	Line     int
-	Column   int
+	File        string
+	Offset      int
+	Line        int
+	Column      int
+	Diagnostics []Diagnostic
+	reader      *bufio.Reader
+	lookahead   [maxLookahead]lookaheadRune
+	buffered    int
+	eof         bool
+	start       Span
+	spelling    []rune
+	atBOL       bool
+	hasSpace    bool
 }
 
-func NewLexer(str string) *Lexer {
-	runes := []rune(str)
+func NewLexer(file string, str string) *Lexer {
+	return NewReaderLexer(file, strings.NewReader(str))
+}
+
+func NewReaderLexer(file string, r io.Reader) *Lexer {
 	return &Lexer{
-		Original: str,
-		Runes:    runes,
-		Index:    0,
-		Line:     1,
-		Column:   1,
+		File:   file,
+		Line:   1,
+		Column: 1,
+		reader: bufio.NewReader(r),
+		atBOL:  true,
 	}
 }
 
-func (l *Lexer) Tokenize(str string) []*Token {
+// Tokenize splits the whole source into tokens. Lexical errors do not stop
+// it; they are collected and returned alongside the tokens, which always end
+// with TK_EOF. Unlike Next, it also diagnoses invalid integer constants,
+// since every token of the source is a token of the program.
+func (l *Lexer) Tokenize() ([]*Token, []Diagnostic) {
 	tokens := []*Token{}
 	for {
-		if l.Index >= len(l.Runes) {
-			tokens = append(tokens, l.createToken(TK_EOF, "EOF"))
-			break
+		token := l.Next()
+		if d, ok := checkNumber(token); ok {
+			l.Diagnostics = append(l.Diagnostics, d)
+		}
+		tokens = append(tokens, token)
+		if token.Type == TK_EOF {
+			return tokens, l.Diagnostics
+		}
+	}
+}
+
+// Next lexes and returns the next token. At the end of input it returns a
+// TK_EOF token, and keeps doing so if called again.
+func (l *Lexer) Next() *Token {
+	for {
+		l.startToken()
+		if l.atEOF() {
+			return l.createToken(TK_EOF, "EOF")
 		}
 		r := l.current()
 		var token *Token
 		switch r {
-		case '+', '-', '*', '/', '(', ')', ';', ',', '{', '}', '&', '[', ']':
-			token = l.createToken(int(r), string(r))
-			l.next()
-		case '!', '=':
-			if l.peek() == '=' {
-				if l.current() == '!' {
-					token = l.createToken(TK_NOTEQUAL, string(r))
-				} else {
-					token = l.createToken(TK_EQUAL, string(r))
-				}
-				l.next()
-			} else {
-				token = l.createToken(int(r), string(r))
+		case '/':
+			if l.peek() == '/' {
+				l.skipLineComment()
+				l.hasSpace = true
+				continue
 			}
-			l.next()
+			if l.peek() == '*' {
+				l.skipBlockComment()
+				l.hasSpace = true
+				continue
+			}
+			token = l.parsePunctuator()
 		case '\n':
-			l.Column = 1
 			l.next()
+			l.atBOL = true
+			l.hasSpace = false
+			continue
+		case ' ', '\t', '\r', '\v', '\f', '　':
+			l.next()
+			l.hasSpace = true
 			continue
-		case ' ', '　':
+		case '\\':
+			if l.skipLineSplice() {
+				continue
+			}
+			if l.peek() == 'u' || l.peek() == 'U' {
+				token = l.parseIdentifier()
+				break
+			}
 			l.next()
+			l.errorAt(l.start, "stray '\\' in program")
 			continue
 		default:
 			if r == '\'' {
-				token = l.parseChar()
+				token = l.parseChar(ENC_NONE)
 			} else if r == '"' {
-				token = l.parseString()
-			} else if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
-				token = l.parseIdentifier()
+				token = l.parseString(ENC_NONE)
+			} else if isIdentifierStart(r) {
+				if token = l.parsePrefixedLiteral(); token == nil {
+					token = l.parseIdentifier()
+				}
 			} else if r >= '0' && r <= '9' {
 				token = l.parseNumber()
-			} else {
-				panic("no expected token: " + string(r))
+			} else if token = l.parsePunctuator(); token == nil {
+				l.next()
+				l.errorAt(l.start, "stray '%c' in program", r)
+				continue
 			}
 		}
-		tokens = append(tokens, token)
+		return token
 	}
-	return tokens
 }
 
+func (l *Lexer) startToken() {
+	l.start = Span{File: l.File, Offset: l.Offset, Line: l.Line, Column: l.Column}
+	l.spelling = l.spelling[:0]
+}
+
+// createToken makes a token spanning from the start of the current token to
+// the lexer's position, so it must be called after the token is consumed.
 func (l *Lexer) createToken(t int, v string) *Token {
-	return &Token{
-		Type:   t,
-		Value:  v,
-		Line:   l.Line,
-		Column: l.Column,
+	span := l.start
+	span.EndOffset = l.Offset
+	span.EndLine = l.Line
+	span.EndColumn = l.Column
+	token := &Token{
+		Span:     span,
+		Type:     t,
+		Value:    v,
+		Spelling: string(l.spelling),
+		AtBOL:    l.atBOL,
+		HasSpace: l.hasSpace,
+	}
+	l.atBOL = false
+	l.hasSpace = false
+	return token
+}
+
+// skipLineSplice skips a backslash-newline pair, which joins two physical
+// source lines into one logical line.
+func (l *Lexer) skipLineSplice() bool {
+	if l.startsWith("\\\n") {
+		l.next()
+		l.next()
+		return true
+	}
+	if l.startsWith("\\\r\n") {
+		l.next()
+		l.next()
+		l.next()
+		return true
+	}
+	return false
+}
+
+// NextHeaderName lexes the operand of #include. If the rest of the line
+// starts with "..." or <...> it returns a TK_HEADER_NAME token whose Value
+// keeps the delimiters and no escape processing is done; otherwise it lexes
+// an ordinary token.
+func (l *Lexer) NextHeaderName() *Token {
+	for {
+		r := l.current()
+		if r == ' ' || r == '\t' || r == '\r' || r == '\v' || r == '\f' {
+			l.next()
+			l.hasSpace = true
+		} else if r == '/' && l.peek() == '*' {
+			l.startToken()
+			l.skipBlockComment()
+			l.hasSpace = true
+		} else if !l.skipLineSplice() {
+			break
+		}
+	}
+	var closing rune
+	switch l.current() {
+	case '"':
+		closing = '"'
+	case '<':
+		closing = '>'
+	default:
+		return l.Next()
+	}
+	l.startToken()
+	runes := []rune{l.current()}
+	for {
+		r := l.next()
+		if l.atEOF() || r == '\n' {
+			l.errorAt(l.start, "missing terminating %c character", closing)
+			return l.createToken(TK_HEADER_NAME, string(runes)+string(closing))
+		}
+		runes = append(runes, r)
+		if r == closing {
+			l.next()
+			return l.createToken(TK_HEADER_NAME, string(runes))
+		}
 	}
 }
 
+func (l *Lexer) errorAt(span Span, format string, args ...interface{}) {
+	l.Diagnostics = append(l.Diagnostics, Diagnostic{
+		Span:     span,
+		Severity: DIAG_ERROR,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// errorf reports an error at the current position.
+func (l *Lexer) errorf(format string, args ...interface{}) {
+	l.errorAt(Span{File: l.File, Offset: l.Offset, Line: l.Line, Column: l.Column}, format, args...)
+}
+
+func (l *Lexer) parsePunctuator() *Token {
+	for _, p := range punctuators {
+		if l.startsWith(p.Value) {
+			for range p.Value {
+				l.next()
+			}
+			return l.createToken(p.Type, p.Value)
+		}
+	}
+	return nil
+}
+
 func (l *Lexer) parseNumber() *Token {
 	runes := []rune{}
 	r := l.current()
 	for {
-		if r >= '0' && r <= '9' {
+		if isPPNumberRune(r) {
+			runes = append(runes, r)
+		} else if (r == '+' || r == '-') && len(runes) > 0 && strings.ContainsRune("eEpP", runes[len(runes)-1]) {
 			runes = append(runes, r)
 		} else {
 			break
 		}
 		r = l.next()
-		if len(l.Runes) <= l.Index {
+		if l.atEOF() {
 			break
 		}
 	}
 	return l.createToken(TK_NUMBER, string(runes))
 }
 
+// numberChecker passes on the tokens of a TokenSource, diagnosing the
+// TK_NUMBER tokens that are not valid integer constants. A pp-number is
+// only checked once it is a token of the program, so unused macros and
+// skipped groups may contain any pp-number.
+type numberChecker struct {
+	source      TokenSource
+	Diagnostics []Diagnostic
+}
+
+func (c *numberChecker) Next() *Token {
+	t := c.source.Next()
+	if d, ok := checkNumber(t); ok {
+		c.Diagnostics = append(c.Diagnostics, d)
+	}
+	return t
+}
+
+// checkNumber returns the error of a TK_NUMBER token that is not a valid
+// integer constant.
+func checkNumber(t *Token) (Diagnostic, bool) {
+	if t.Type != TK_NUMBER {
+		return Diagnostic{}, false
+	}
+	if _, _, err := parseIntegerLiteral(t.Value); err != nil {
+		return tokenDiagnostic(t, DIAG_ERROR, err.Error()), true
+	}
+	return Diagnostic{}, false
+}
+
+func isPPNumberRune(r rune) bool {
+	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r == '.'
+}
+
+// parseIntegerLiteral converts the spelling of an integer constant into its
+// value and type following C11 6.4.4.1: the type is the first of the
+// candidate types for the suffix and base that can represent the value.
+func parseIntegerLiteral(s string) (uint64, *Ctype, error) {
+	base := 10
+	digits := s
+	switch {
+	case len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X"):
+		base, digits = 16, s[2:]
+	case len(s) > 2 && (s[:2] == "0b" || s[:2] == "0B"):
+		base, digits = 2, s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base, digits = 8, s[1:]
+	}
+
+	end := 0
+	for end < len(digits) && digitValue(digits[end]) < 16 {
+		end++
+	}
+	suffix := digits[end:]
+	digits = digits[:end]
+	if digits == "" && base != 8 {
+		return 0, nil, fmt.Errorf("invalid integer constant '%s'", s)
+	}
+
+	var value uint64
+	for i := 0; i < len(digits); i++ {
+		d := digitValue(digits[i])
+		if d >= base {
+			if base == 8 {
+				return 0, nil, fmt.Errorf("invalid digit '%c' in octal constant", digits[i])
+			}
+			return 0, nil, fmt.Errorf("invalid digit '%c' in integer constant '%s'", digits[i], s)
+		}
+		if value > (math.MaxUint64-uint64(d))/uint64(base) {
+			return 0, nil, fmt.Errorf("integer constant is too large: %s", s)
+		}
+		value = value*uint64(base) + uint64(d)
+	}
+
+	unsigned, long := false, false
+	switch strings.ToLower(suffix) {
+	case "":
+	case "u":
+		unsigned = true
+	case "l", "ll":
+		long = true
+	case "ul", "lu", "ull", "llu":
+		unsigned, long = true, true
+	default:
+		return 0, nil, fmt.Errorf("invalid suffix '%s' on integer constant", suffix)
+	}
+	if strings.Contains(suffix, "lL") || strings.Contains(suffix, "Ll") {
+		return 0, nil, fmt.Errorf("invalid suffix '%s' on integer constant", suffix)
+	}
+
+	var candidates []*Ctype
+	switch {
+	case unsigned && long:
+		candidates = []*Ctype{ctype_ulong}
+	case unsigned:
+		candidates = []*Ctype{ctype_uint, ctype_ulong}
+	case long && base == 10:
+		candidates = []*Ctype{ctype_long}
+	case long:
+		candidates = []*Ctype{ctype_long, ctype_ulong}
+	case base == 10:
+		candidates = []*Ctype{ctype_int, ctype_long}
+	default:
+		candidates = []*Ctype{ctype_int, ctype_uint, ctype_long, ctype_ulong}
+	}
+	for _, ctype := range candidates {
+		if value <= ctype.maxValue() {
+			return value, ctype, nil
+		}
+	}
+	// A decimal constant too large for long is given unsigned long, as gcc does.
+	return value, ctype_ulong, nil
+}
+
+func digitValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return 16
+}
+
 func (l *Lexer) parseIdentifier() *Token {
 	runes := []rune{}
 	r := l.current()
-	for {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9' && len(runes) > 0) {
-			runes = append(runes, r)
-		} else {
-			break
+	for !l.atEOF() {
+		if r == '\\' && (l.peek() == 'u' || l.peek() == 'U') {
+			v, _ := l.readEscape()
+			if len(runes) == 0 && !isIdentifierStart(rune(v)) {
+				l.errorAt(l.start, "universal character \\U%08X is not valid at the start of an identifier", v)
+			}
+			runes = append(runes, rune(v))
+			r = l.current()
+			continue
 		}
-		r = l.next()
-		if len(l.Runes) <= l.Index {
+		if !isIdentifierStart(r) && !isIdentifierContinue(r) {
 			break
 		}
+		runes = append(runes, r)
+		r = l.next()
 	}
 	ident := string(runes)
 	if v, ok := reservationTypes[ident]; ok {
@@ -155,57 +714,300 @@ func (l *Lexer) parseIdentifier() *Token {
 	return l.createToken(TK_IDENT, ident)
 }
 
-func (l *Lexer) parseChar() *Token {
+// isIdentifierStart reports whether r may begin an identifier. Besides the
+// basic Latin letters and underscore this accepts '$' as a common extension
+// and any letter outside ASCII, which covers UTF-8 identifiers in sources.
+func isIdentifierStart(r rune) bool {
+	if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r == '$' {
+		return true
+	}
+	return r >= 0x80 && unicode.IsLetter(r)
+}
+
+func isIdentifierContinue(r rune) bool {
+	if r >= '0' && r <= '9' {
+		return true
+	}
+	return r >= 0x80 && (unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc, unicode.Pc))
+}
+
+// parsePrefixedLiteral lexes a character constant or string literal with an
+// encoding prefix, or returns nil if none starts here.
+func (l *Lexer) parsePrefixedLiteral() *Token {
+	for _, p := range encodingPrefixes {
+		if l.startsWith(p.Value + "\"") {
+			for range p.Value {
+				l.next()
+			}
+			return l.parseString(p.Encoding)
+		}
+		if l.startsWith(p.Value + "'") {
+			for range p.Value {
+				l.next()
+			}
+			return l.parseChar(p.Encoding)
+		}
+	}
+	return nil
+}
+
+func (l *Lexer) parseChar(encoding int) *Token {
 	if l.current() != '\'' {
 		return nil
 	}
-	r := l.next()
-	if r == '\'' {
-		return nil
+	value, ok := l.readQuoted('\'', encoding)
+	token := l.createToken(TK_CHARACTER, value)
+	token.Encoding = encoding
+	if ok && value == "" {
+		l.errorAt(token.Span, "empty character constant")
 	}
-	if l.next() != '\'' {
+	return token
+}
+
+func (l *Lexer) parseString(encoding int) *Token {
+	if l.current() != '"' {
 		return nil
 	}
+	value, _ := l.readQuoted('"', encoding)
+	token := l.createToken(TK_STRING, value)
+	token.Encoding = encoding
+	return token
+}
+
+// readQuoted reads a character constant or string literal body enclosed in
+// quote and returns it with escape sequences decoded into code units of the
+// encoding. Universal character names and source characters outside ASCII
+// are encoded as UTF-8, UTF-16 or UTF-32 according to the unit width.
+// ok is false when the closing quote is missing.
+func (l *Lexer) readQuoted(quote rune, encoding int) (value string, ok bool) {
+	buf := []byte{}
+	size := encodingSize(encoding)
 	l.next()
-	return l.createToken(TK_CHAR, string(r))
+	for {
+		r := l.current()
+		if l.atEOF() || r == '\n' {
+			if quote == '"' {
+				l.errorAt(l.start, "missing terminating '\"' character")
+			} else {
+				l.errorAt(l.start, "missing terminating ' character")
+			}
+			return string(buf), false
+		}
+		if r == quote {
+			l.next()
+			return string(buf), true
+		}
+		if r != '\\' {
+			buf = appendCharacter(buf, r, size)
+			l.next()
+			continue
+		}
+		v, universal := l.readEscape()
+		if universal {
+			buf = appendCharacter(buf, rune(v), size)
+			continue
+		}
+		if size < 4 && v >= 1<<uint(size*8) {
+			l.errorf("escape sequence out of range")
+		}
+		buf = appendCodeUnit(buf, v, size)
+	}
 }
 
-func (l *Lexer) parseString() *Token {
-	if l.current() != '"' {
-		return nil
+// appendCharacter encodes r in UTF-8, UTF-16 or UTF-32 depending on the code
+// unit size and appends the units to buf.
+func appendCharacter(buf []byte, r rune, size int) []byte {
+	switch size {
+	case 1:
+		return append(buf, string(r)...)
+	case 2:
+		for _, u := range utf16.Encode([]rune{r}) {
+			buf = appendCodeUnit(buf, uint32(u), size)
+		}
+		return buf
 	}
+	return appendCodeUnit(buf, uint32(r), size)
+}
+
+// appendCodeUnit appends the little-endian representation of v.
+func appendCodeUnit(buf []byte, v uint32, size int) []byte {
+	for i := 0; i < size; i++ {
+		buf = append(buf, byte(v>>uint(8*i)))
+	}
+	return buf
+}
+
+// codeUnits splits the little-endian representation of a literal back into
+// code units.
+func codeUnits(s string, size int) []uint32 {
+	units := make([]uint32, len(s)/size)
+	for i := range units {
+		for j := 0; j < size; j++ {
+			units[i] |= uint32(s[i*size+j]) << uint(8*j)
+		}
+	}
+	return units
+}
+
+var simpleEscapes = map[rune]uint32{
+	'\'': '\'',
+	'"':  '"',
+	'?':  '?',
+	'\\': '\\',
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'e':  0x1B, // GNU extension
+}
+
+// readEscape decodes the escape sequence starting at the current backslash.
+// universal reports whether the value is a code point (\u, \U) rather than
+// the raw value of a code unit (octal and hex escapes).
+func (l *Lexer) readEscape() (value uint32, universal bool) {
 	r := l.next()
-	runes := []rune{}
+	if v, ok := simpleEscapes[r]; ok {
+		l.next()
+		return v, false
+	}
+	switch {
+	case r >= '0' && r <= '7':
+		for i := 0; i < 3 && r >= '0' && r <= '7'; i++ {
+			value = value*8 + uint32(r-'0')
+			r = l.next()
+		}
+		return value, false
+	case r == 'x':
+		r = l.next()
+		if r >= 0x80 || digitValue(byte(r)) >= 16 {
+			l.errorf("\\x used with no following hex digits")
+		}
+		overflow := false
+		for r < 0x80 && digitValue(byte(r)) < 16 {
+			overflow = overflow || value > 0xFFFFFFF
+			value = value*16 + uint32(digitValue(byte(r)))
+			r = l.next()
+		}
+		if overflow {
+			l.errorf("hex escape sequence out of range")
+		}
+		return value, false
+	case r == 'u' || r == 'U':
+		name, n := r, 4
+		if r == 'U' {
+			n = 8
+		}
+		r = l.next()
+		for i := 0; i < n; i++ {
+			if r >= 0x80 || digitValue(byte(r)) >= 16 {
+				l.errorf("incomplete universal character name")
+				return utf8.RuneError, true
+			}
+			value = value*16 + uint32(digitValue(byte(r)))
+			r = l.next()
+		}
+		if value > utf8.MaxRune || (value >= 0xD800 && value <= 0xDFFF) {
+			l.errorf("\\%c%0*X is not a valid universal character", name, n, value)
+			return utf8.RuneError, true
+		}
+		return value, true
+	}
+	// Unknown escapes stand for the character itself, as gcc does.
+	l.next()
+	return uint32(r), true
+}
+
+func (l *Lexer) skipLineComment() {
+	for !l.atEOF() && l.current() != '\n' {
+		l.next()
+	}
+}
+
+func (l *Lexer) skipBlockComment() {
+	l.next()
+	l.next()
 	for {
-		if len(l.Runes) <= l.Index {
-			break
+		if l.atEOF() {
+			l.errorAt(l.start, "unterminated comment")
+			return
 		}
-		if r == '"' {
+		if l.current() == '*' && l.peek() == '/' {
 			l.next()
-			break
+			l.next()
+			return
 		}
-		runes = append(runes, r)
-		r = l.next()
+		l.next()
 	}
-	return l.createToken(TK_STRING, string(runes))
+}
+
+// fill reads runes from the input until n are buffered or the input ends.
+func (l *Lexer) fill(n int) {
+	for l.buffered < n && !l.eof {
+		r, size, err := l.reader.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				l.errorf("cannot read source: %s", err)
+			}
+			l.eof = true
+			return
+		}
+		l.lookahead[l.buffered] = lookaheadRune{r: r, size: size}
+		l.buffered++
+	}
+}
+
+func (l *Lexer) atEOF() bool {
+	l.fill(1)
+	return l.buffered == 0
+}
+
+func (l *Lexer) startsWith(s string) bool {
+	i := 0
+	for _, r := range s {
+		l.fill(i + 1)
+		if l.buffered <= i || l.lookahead[i].r != r {
+			return false
+		}
+		i++
+	}
+	return true
 }
 
 func (l *Lexer) current() rune {
-	if len(l.Runes) <= l.Index {
+	l.fill(1)
+	if l.buffered == 0 {
 		return 0
 	}
-	return l.Runes[l.Index]
+	return l.lookahead[0].r
 }
 
 func (l *Lexer) peek() rune {
-	if len(l.Runes) <= l.Index {
+	l.fill(2)
+	if l.buffered < 2 {
 		return 0
 	}
-	return l.Runes[l.Index+1]
+	return l.lookahead[1].r
 }
 
 func (l *Lexer) next() rune {
-	l.Index++
-	l.Column++
+	if l.atEOF() {
+		return 0
+	}
+	switch l.current() {
+	case '\n':
+		l.Line++
+		l.Column = 1
+	case '\t':
+		l.Column += TabStop - (l.Column-1)%TabStop
+	default:
+		l.Column++
+	}
+	l.Offset += l.lookahead[0].size
+	l.spelling = append(l.spelling, l.lookahead[0].r)
+	copy(l.lookahead[:], l.lookahead[1:l.buffered])
+	l.buffered--
 	return l.current()
 }
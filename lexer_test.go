@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestTokenizeDiagnostics checks that Tokenize reports every lexical error
+// with its position and goes on to the end of the source.
+func TestTokenizeDiagnostics(t *testing.T) {
+	source := "int a = 09;\nchar c = '';\n@\nchar *s = \"abc\n"
+	tokens, diagnostics := NewLexer("x.c", source).Tokenize()
+	want := []string{
+		"x.c:1:9: error: invalid digit '9' in octal constant",
+		"x.c:2:10: error: empty character constant",
+		"x.c:3:1: error: stray '@' in program",
+		"x.c:4:11: error: missing terminating '\"' character",
+	}
+	if len(diagnostics) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diagnostics), len(want), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.Error() != want[i] {
+			t.Errorf("diagnostic %d: got %q, want %q", i, d.Error(), want[i])
+		}
+	}
+	if last := tokens[len(tokens)-1]; last.Type != TK_EOF {
+		t.Errorf("last token: got %q, want EOF", last.Value)
+	}
+}
+
+// writeSource writes a translation unit of about size bytes and returns its
+// path.
+func writeSource(b *testing.B, size int) string {
+	var sb strings.Builder
+	sb.WriteString("#define ADD(a, b) ((a) + (b))\nint main() {\n    int x = 0;\n")
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb, "    x = ADD(x, %d); /* step %d */\n", i%1000, i)
+	}
+	sb.WriteString("    return x;\n}\n")
+	path := filepath.Join(b.TempDir(), "large.c")
+	if err := os.WriteFile(path, []byte(sb.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// liveHeap returns the bytes of heap still reachable after a collection.
+func liveHeap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkTokenStream preprocesses and lexes inputs of growing size and
+// reports the largest live heap seen while reading their tokens. It stays
+// flat as the input grows: no token is kept once it has been read.
+func BenchmarkTokenStream(b *testing.B) {
+	for _, size := range []int{1 << 20, 4 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			path := writeSource(b, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				pp := NewPreprocessor()
+				pp.Start(path)
+				for n := 0; ; n++ {
+					if pp.Next().Type == TK_EOF {
+						break
+					}
+					if n%(1<<16) == 0 {
+						b.StopTimer()
+						if heap := liveHeap(); heap > peak {
+							peak = heap
+						}
+						b.StartTimer()
+					}
+				}
+				if len(pp.Diagnostics) > 0 {
+					b.Fatal(pp.Diagnostics[0].Error())
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"strings"
+)
+
+// HideSet is the set of macro names a token was produced by. A token is not
+// expanded by a macro in its hide set, which makes recursive macros stop
+// (Prosser's algorithm).
+type HideSet map[string]bool
+
+func (h HideSet) with(name string) HideSet {
+	result := HideSet{name: true}
+	for n := range h {
+		result[n] = true
+	}
+	return result
+}
+
+func (h HideSet) union(other HideSet) HideSet {
+	result := HideSet{}
+	for n := range h {
+		result[n] = true
+	}
+	for n := range other {
+		result[n] = true
+	}
+	return result
+}
+
+func (h HideSet) intersect(other HideSet) HideSet {
+	result := HideSet{}
+	for n := range h {
+		if other[n] {
+			result[n] = true
+		}
+	}
+	return result
+}
+
+// Expansion records that a token was produced by the expansion of Macro
+// used at Span. Parent is the expansion the use itself came from.
+type Expansion struct {
+	Macro  string
+	Span   Span
+	Parent *Expansion
+}
+
+// Macro is a macro definition. A macro with a Handler is a dynamic
+// object-like macro such as __LINE__ whose Body is computed at each use.
+type Macro struct {
+	Span
+	Name         string
+	FunctionLike bool
+	Params       []string
+	Variadic     bool
+	Body         []*Token
+	Handler      func(pp *Preprocessor, token *Token) []*Token
+}
+
+// macroArg is an argument of a function-like macro invocation. Expanded is
+// computed on first use since arguments next to # and ## are not expanded.
+type macroArg struct {
+	Tokens   []*Token
+	Expanded []*Token
+	expanded bool
+}
+
+func isIdentifierToken(t *Token) bool {
+	if t.Type == TK_IDENT {
+		return true
+	}
+	keyword, ok := reservationTypes[t.Value]
+	return ok && keyword == t.Type
+}
+
+func (pp *Preprocessor) define(file *sourceFile, directive *Token) {
+	name := file.next()
+	if name.AtBOL || name.Type == TK_EOF {
+		file.unread(name)
+		pp.errorAt(directive.Span, "no macro name given in #define directive")
+		return
+	}
+	if !isIdentifierToken(name) {
+		pp.errorAt(name.Span, "macro names must be identifiers")
+		pp.readLine(file)
+		return
+	}
+	if name.Value == "defined" {
+		pp.errorAt(name.Span, "\"defined\" cannot be used as a macro name")
+		pp.readLine(file)
+		return
+	}
+	macro := &Macro{Span: name.Span, Name: name.Value}
+	line := pp.readLine(file)
+	if len(line) > 0 && line[0].Type == '(' && !line[0].HasSpace {
+		macro.FunctionLike = true
+		rest, ok := pp.macroParams(macro, line[0], line[1:])
+		if !ok {
+			return
+		}
+		line = rest
+	} else if len(line) > 0 && !line[0].HasSpace {
+		pp.warningAt(line[0].Span, "missing whitespace after the macro name")
+	}
+	macro.Body = line
+	if !pp.checkMacroBody(macro) {
+		return
+	}
+	if old, ok := pp.Macros[macro.Name]; ok && !sameMacro(old, macro) {
+		pp.warningAt(name.Span, "\"%s\" redefined", macro.Name)
+	}
+	pp.Macros[macro.Name] = macro
+}
+
+// macroParams parses the parameter list of a function-like macro and returns
+// the tokens following it.
+func (pp *Preprocessor) macroParams(macro *Macro, lparen *Token, tokens []*Token) ([]*Token, bool) {
+	if len(tokens) > 0 && tokens[0].Type == ')' {
+		return tokens[1:], true
+	}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.Type == TK_ELLIPSIS {
+			macro.Variadic = true
+			macro.Params = append(macro.Params, "__VA_ARGS__")
+		} else if isIdentifierToken(t) {
+			if t.Value == "__VA_ARGS__" {
+				pp.errorAt(t.Span, "__VA_ARGS__ can only appear in the expansion of a C99 variadic macro")
+				return nil, false
+			}
+			for _, p := range macro.Params {
+				if p == t.Value {
+					pp.errorAt(t.Span, "duplicate macro parameter \"%s\"", t.Value)
+					return nil, false
+				}
+			}
+			macro.Params = append(macro.Params, t.Value)
+			if i+1 < len(tokens) && tokens[i+1].Type == TK_ELLIPSIS {
+				// GNU named variadic parameter: "args..."
+				macro.Variadic = true
+				i++
+			}
+		} else {
+			pp.errorAt(t.Span, "expected parameter name, found \"%s\"", t.Spelling)
+			return nil, false
+		}
+		i++
+		if i < len(tokens) && tokens[i].Type == ')' {
+			return tokens[i+1:], true
+		}
+		if i >= len(tokens) || tokens[i].Type != ',' || macro.Variadic {
+			break
+		}
+	}
+	pp.errorAt(lparen.Span, "missing ')' in macro parameter list")
+	return nil, false
+}
+
+func (pp *Preprocessor) checkMacroBody(macro *Macro) bool {
+	body := macro.Body
+	if len(body) > 0 && body[0].Type == TK_HASHHASH {
+		pp.errorAt(body[0].Span, "'##' cannot appear at either end of a macro expansion")
+		return false
+	}
+	if len(body) > 0 && body[len(body)-1].Type == TK_HASHHASH {
+		pp.errorAt(body[len(body)-1].Span, "'##' cannot appear at either end of a macro expansion")
+		return false
+	}
+	if !macro.FunctionLike {
+		return true
+	}
+	for i, t := range body {
+		if t.Type != '#' {
+			continue
+		}
+		if i+1 >= len(body) || (macro.paramIndex(body[i+1]) < 0 && !(macro.Variadic && body[i+1].Value == "__VA_OPT__")) {
+			pp.errorAt(t.Span, "'#' is not followed by a macro parameter")
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Macro) paramIndex(t *Token) int {
+	if !isIdentifierToken(t) {
+		return -1
+	}
+	for i, p := range m.Params {
+		if p == t.Value {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameMacro reports whether two definitions are identical, in which case a
+// redefinition is allowed without a warning.
+func sameMacro(a *Macro, b *Macro) bool {
+	if a.FunctionLike != b.FunctionLike || a.Variadic != b.Variadic ||
+		strings.Join(a.Params, ",") != strings.Join(b.Params, ",") || len(a.Body) != len(b.Body) {
+		return false
+	}
+	for i := range a.Body {
+		if a.Body[i].Spelling != b.Body[i].Spelling || (i > 0 && a.Body[i].HasSpace != b.Body[i].HasSpace) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp *Preprocessor) undef(file *sourceFile, directive *Token) {
+	line := pp.readLine(file)
+	if len(line) == 0 {
+		pp.errorAt(directive.Span, "no macro name given in #undef directive")
+		return
+	}
+	if !isIdentifierToken(line[0]) {
+		pp.errorAt(line[0].Span, "macro names must be identifiers")
+		return
+	}
+	if len(line) > 1 {
+		pp.warningAt(line[1].Span, "extra tokens at end of #undef directive")
+	}
+	delete(pp.Macros, line[0].Value)
+}
+
+// expand expands token if it names a macro. The replacement is pushed back
+// to be rescanned and true is returned.
+func (pp *Preprocessor) expand(token *Token) bool {
+	if !isIdentifierToken(token) || token.HideSet[token.Value] {
+		return false
+	}
+	macro, ok := pp.Macros[token.Value]
+	if !ok {
+		return false
+	}
+	if macro.Handler != nil {
+		macro = &Macro{Name: macro.Name, Body: macro.Handler(pp, token)}
+	}
+	if !macro.FunctionLike {
+		pp.unreadTokens(pp.substitute(macro, token, nil, token.HideSet.with(macro.Name)))
+		return true
+	}
+
+	lparen := pp.read()
+	if lparen == nil || lparen.Type != '(' {
+		if lparen != nil {
+			pp.unreadTokens([]*Token{lparen})
+		}
+		return false
+	}
+	args, rparen, ok := pp.readMacroArgs(macro, token)
+	if !ok {
+		return true
+	}
+	hideSet := token.HideSet.intersect(rparen.HideSet).with(macro.Name)
+	pp.unreadTokens(pp.substitute(macro, token, args, hideSet))
+	return true
+}
+
+// readMacroArgs reads the arguments of a function-like macro invocation up
+// to and including the closing parenthesis.
+func (pp *Preprocessor) readMacroArgs(macro *Macro, name *Token) ([]*macroArg, *Token, bool) {
+	args := []*macroArg{{}}
+	depth := 0
+	for {
+		t := pp.read()
+		if t == nil || t.Type == TK_EOF {
+			if t != nil {
+				pp.unreadTokens([]*Token{t})
+			}
+			pp.errorAtToken(name, "unterminated argument list invoking macro \"%s\"", macro.Name)
+			return nil, nil, false
+		}
+		switch {
+		case t.Type == '(':
+			depth++
+		case t.Type == ')' && depth > 0:
+			depth--
+		case t.Type == ')':
+			if len(macro.Params) == 0 && len(args) == 1 && len(args[0].Tokens) == 0 {
+				args = nil
+			}
+			if macro.Variadic && len(args) == len(macro.Params)-1 {
+				// the variable arguments may be omitted entirely
+				args = append(args, &macroArg{})
+			}
+			if len(args) != len(macro.Params) {
+				pp.errorAtToken(name, "macro \"%s\" passed %d arguments, but takes %d", macro.Name, len(args), len(macro.Params))
+				return nil, nil, false
+			}
+			return args, t, true
+		case t.Type == ',' && depth == 0 && !(macro.Variadic && len(args) == len(macro.Params)):
+			args = append(args, &macroArg{})
+			continue
+		}
+		arg := args[len(args)-1]
+		arg.Tokens = append(arg.Tokens, t)
+	}
+}
+
+// substitute builds the replacement list of a macro invocation: parameters
+// are replaced by their arguments, # and ## are applied, and every resulting
+// token is given hideSet. The tokens of the body keep their spans in the
+// definition and record the expansion at name.
+func (pp *Preprocessor) substitute(macro *Macro, name *Token, args []*macroArg, hideSet HideSet) []*Token {
+	expansion := &Expansion{Macro: macro.Name, Span: name.Span, Parent: name.Expansion}
+	result := pp.substituteBody(macro, macro.Body, args, expansion)
+	for i, t := range result {
+		t = t.copy()
+		t.HideSet = t.HideSet.union(hideSet)
+		if i == 0 {
+			t.AtBOL = name.AtBOL
+			t.HasSpace = name.HasSpace
+		}
+		result[i] = t
+	}
+	return result
+}
+
+func (pp *Preprocessor) substituteBody(macro *Macro, body []*Token, args []*macroArg, expansion *Expansion) []*Token {
+	result := []*Token{}
+	// pasteLeft reports whether the next token is the right operand of ##;
+	// placemarker is set when the left operand was an empty argument.
+	pasteLeft, placemarker := false, false
+	for i := 0; i < len(body); i++ {
+		t := body[i]
+		pastesRight := i+1 < len(body) && body[i+1].Type == TK_HASHHASH
+
+		var tokens []*Token
+		switch {
+		case macro.FunctionLike && t.Type == '#' && i+1 < len(body):
+			i++
+			var operand []*Token
+			if body[i].Value == "__VA_OPT__" {
+				content, end := pp.vaOptContent(body, i)
+				i = end
+				operand = pp.vaOpt(macro, content, args, expansion)
+			} else {
+				operand = args[macro.paramIndex(body[i])].Tokens
+			}
+			tokens = []*Token{expanded(stringize(t, operand), expansion)}
+			pastesRight = i+1 < len(body) && body[i+1].Type == TK_HASHHASH
+		case macro.Variadic && t.Value == "__VA_OPT__" && isIdentifierToken(t):
+			content, end := pp.vaOptContent(body, i)
+			i = end
+			tokens = withLeadingSpace(pp.vaOpt(macro, content, args, expansion), t.HasSpace)
+			pastesRight = i+1 < len(body) && body[i+1].Type == TK_HASHHASH
+		case macro.paramIndex(t) >= 0:
+			index := macro.paramIndex(t)
+			arg := args[index]
+			if pasteLeft && macro.Variadic && index == len(macro.Params)-1 && len(result) > 0 && result[len(result)-1].Type == ',' && !placemarker {
+				// GNU extension: ", ## __VA_ARGS__" drops the comma when the
+				// variable arguments are empty and is not a paste otherwise.
+				if len(arg.Tokens) == 0 {
+					result = result[:len(result)-1]
+				}
+				pasteLeft = false
+			}
+			if pasteLeft || pastesRight {
+				tokens = arg.Tokens
+			} else {
+				tokens = pp.expandArg(arg)
+			}
+			tokens = withLeadingSpace(tokens, t.HasSpace)
+		default:
+			tokens = []*Token{expanded(t, expansion)}
+		}
+
+		if pasteLeft {
+			if len(tokens) > 0 && !placemarker && len(result) > 0 {
+				pasted, ok := pp.paste(result[len(result)-1], tokens[0])
+				if ok {
+					result[len(result)-1] = pasted
+					tokens = tokens[1:]
+				}
+			}
+			placemarker = placemarker && len(tokens) == 0
+		} else {
+			placemarker = len(tokens) == 0
+		}
+		result = append(result, tokens...)
+
+		pasteLeft = false
+		if pastesRight {
+			i++
+			pasteLeft = true
+		}
+	}
+	return result
+}
+
+// expanded returns a copy of a token of a macro body produced by expansion.
+func expanded(t *Token, expansion *Expansion) *Token {
+	t = t.copy()
+	t.Expansion = expansion
+	return t
+}
+
+// withLeadingSpace gives the first of tokens the spacing of the token it
+// replaces.
+func withLeadingSpace(tokens []*Token, hasSpace bool) []*Token {
+	if len(tokens) == 0 {
+		return tokens
+	}
+	first := tokens[0].copy()
+	first.HasSpace = hasSpace
+	return append([]*Token{first}, tokens[1:]...)
+}
+
+// vaOptContent returns the tokens between the parentheses of the __VA_OPT__
+// at body[i] and the index of its closing parenthesis.
+func (pp *Preprocessor) vaOptContent(body []*Token, i int) ([]*Token, int) {
+	if i+1 >= len(body) || body[i+1].Type != '(' {
+		pp.errorAt(body[i].Span, "__VA_OPT__ must be followed by an open parenthesis")
+		return nil, i
+	}
+	depth := 0
+	for j := i + 1; j < len(body); j++ {
+		switch body[j].Type {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return body[i+2 : j], j
+			}
+		}
+	}
+	pp.errorAt(body[i].Span, "unterminated __VA_OPT__")
+	return nil, len(body) - 1
+}
+
+// vaOpt substitutes the content of __VA_OPT__ if the variable arguments
+// expand to at least one token, and yields nothing otherwise.
+func (pp *Preprocessor) vaOpt(macro *Macro, content []*Token, args []*macroArg, expansion *Expansion) []*Token {
+	if len(pp.expandArg(args[len(args)-1])) == 0 {
+		return nil
+	}
+	return pp.substituteBody(macro, content, args, expansion)
+}
+
+// expandArg fully macro-expands an argument, computing it only once.
+func (pp *Preprocessor) expandArg(arg *macroArg) []*Token {
+	if !arg.expanded {
+		arg.Expanded, arg.expanded = pp.expandTokens(arg.Tokens), true
+	}
+	return arg.Expanded
+}
+
+// expandTokens fully macro-expands tokens in isolation from the tokens that
+// follow them.
+func (pp *Preprocessor) expandTokens(tokens []*Token) []*Token {
+	saved := pp.pending
+	pp.pending = nil
+	sentinel := &Token{Type: TK_EOF}
+	pp.unreadTokens(append(append([]*Token{}, tokens...), sentinel))
+	result := []*Token{}
+	for {
+		t := pp.read()
+		if t == sentinel {
+			break
+		}
+		if !pp.expand(t) {
+			result = append(result, t)
+		}
+	}
+	pp.pending = saved
+	return result
+}
+
+// stringize implements the # operator: it spells the argument tokens as a
+// string literal, with one space wherever they had whitespace in between,
+// including a line break.
+func stringize(hash *Token, tokens []*Token) *Token {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 && (t.HasSpace || t.AtBOL) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.Spelling)
+	}
+	value := b.String()
+	var spelling strings.Builder
+	spelling.WriteByte('"')
+	for i, t := range tokens {
+		if i > 0 && (t.HasSpace || t.AtBOL) {
+			spelling.WriteByte(' ')
+		}
+		if t.Type == TK_STRING || t.Type == TK_CHARACTER {
+			spelling.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(t.Spelling))
+		} else {
+			spelling.WriteString(t.Spelling)
+		}
+	}
+	spelling.WriteByte('"')
+
+	// The value of the string is what a lexer would decode from its spelling.
+	lexer := NewLexer(hash.File, spelling.String())
+	token := lexer.Next()
+	if token.Type != TK_STRING {
+		token = &Token{Type: TK_STRING, Value: value, Spelling: spelling.String()}
+	}
+	token.Span = hash.Span
+	token.HasSpace = hash.HasSpace
+	token.AtBOL = false
+	return token
+}
+
+// paste implements the ## operator by lexing the concatenated spellings,
+// which must form exactly one token.
+func (pp *Preprocessor) paste(left *Token, right *Token) (*Token, bool) {
+	spelling := left.Spelling + right.Spelling
+	lexer := NewLexer(left.File, spelling)
+	token := lexer.Next()
+	if token.Type == TK_EOF || lexer.Next().Type != TK_EOF || len(lexer.Diagnostics) > 0 || token.Spelling != spelling {
+		pp.errorAtToken(left, "pasting \"%s\" and \"%s\" does not give a valid preprocessing token", left.Spelling, right.Spelling)
+		return nil, false
+	}
+	token.Span = left.Span
+	token.Expansion = left.Expansion
+	token.AtBOL = left.AtBOL
+	token.HasSpace = left.HasSpace
+	token.HideSet = left.HideSet.intersect(right.HideSet)
+	return token, true
+}
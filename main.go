@@ -1,23 +1,97 @@
 package main
 
 import (
-	"io/ioutil"
+	"fmt"
 	"os"
+	"strings"
 )
 
+const usage = "usage: mycc [-E] [-I dir] [-isystem dir] [-D name[=value]] [-U name] file.c"
+
 func main() {
-	content, err := ioutil.ReadFile(os.Args[1])
-	if err != nil {
-		panic(err)
+	pp := NewPreprocessor()
+	if epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		t, ok := SourceDateEpoch(epoch)
+		if !ok {
+			fail(fmt.Sprintf("environment variable SOURCE_DATE_EPOCH must expand to a non-negative integer less than or equal to %d", MaxSourceDateEpoch))
+		}
+		pp.Time = t
+	}
+	input := ""
+	preprocessOnly := false
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-E":
+			preprocessOnly = true
+		case strings.HasPrefix(arg, "-isystem"):
+			pp.SystemIncludePaths = append(pp.SystemIncludePaths, optionValue(args, &i, "-isystem"))
+		case strings.HasPrefix(arg, "-I"):
+			pp.IncludePaths = append(pp.IncludePaths, optionValue(args, &i, "-I"))
+		case strings.HasPrefix(arg, "-D"):
+			pp.Define(optionValue(args, &i, "-D"))
+		case strings.HasPrefix(arg, "-U"):
+			pp.Undefine(optionValue(args, &i, "-U"))
+		case strings.HasPrefix(arg, "-") || input != "":
+			fail(usage)
+		default:
+			input = arg
+		}
+	}
+	if input == "" {
+		fail(usage)
+	}
+
+	pp.Start(input)
+	if preprocessOnly {
+		err := pp.WritePreprocessed(os.Stdout)
+		report(pp.Diagnostics)
+		if err != nil {
+			fail(err.Error())
+		}
+		return
 	}
-	parse(string(content))
+	compile(pp)
 }
 
-func parse(str string) {
-	l := NewLexer(str)
-	tokens := l.Tokenize(str)
+// optionValue returns the value of an option given either joined to it
+// ("-Idir") or as the next argument ("-I dir").
+func optionValue(args []string, i *int, name string) string {
+	if value := args[*i][len(name):]; value != "" {
+		return value
+	}
+	*i++
+	if *i >= len(args) {
+		fail(fmt.Sprintf("missing argument to '%s'", name))
+	}
+	return args[*i]
+}
+
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, "mycc: "+message)
+	os.Exit(1)
+}
+
+// compile parses the tokens of pp as they are produced and generates the
+// program. The diagnostics of the preprocessor come first, and parse
+// errors are only reported if it found none.
+func compile(pp *Preprocessor) {
+	tokens := &numberChecker{source: pp}
 	p := NewParser(tokens)
 	declarations := p.Parse()
+	report(append(pp.Diagnostics, tokens.Diagnostics...))
+	report(p.Diagnostics)
 	g := NewGenerator(p.Strings)
 	g.generate(declarations)
 }
+
+// report prints diagnostics and exits if any is an error.
+func report(diagnostics []Diagnostic) {
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, d.Error())
+	}
+	if hasErrors(diagnostics) {
+		os.Exit(1)
+	}
+}
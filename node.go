@@ -3,6 +3,14 @@ package main
 const (
 	ND_EQUAL = iota + 256
 	ND_NOTEQUAL
+	ND_LE
+	ND_GE
+	ND_LSHIFT
+	ND_RSHIFT
+	ND_LOGAND
+	ND_LOGOR
+	ND_POSTINC
+	ND_POSTDEC
 )
 
 const (
@@ -10,11 +18,21 @@ const (
 	TYPE_CHAR
 	TYPE_PTR
 	TYPE_ARRAY
+	TYPE_LONG
+	TYPE_SHORT
+	TYPE_BOOL
 )
 
-var ctypeMap = map[string]*Ctype{
-	"int":  ctype_int,
-	"char": ctype_char,
+// typeSpecifiers are the keywords that combine into an integer type, such
+// as unsigned long int.
+var typeSpecifiers = map[int]bool{
+	TK_CHAR:     true,
+	TK_SHORT:    true,
+	TK_INT:      true,
+	TK_LONG:     true,
+	TK_SIGNED:   true,
+	TK_UNSIGNED: true,
+	TK_BOOL:     true,
 }
 
 type Ctype struct {
@@ -22,10 +40,54 @@ type Ctype struct {
 	Ptrof     *Ctype
 	Size      int
 	ArraySize int
+	Unsigned  bool
+}
+
+// convert returns value converted to an integer type, wrapping around to
+// its width. _Bool takes 1 for any value other than 0.
+func (c *Ctype) convert(value int) int {
+	if c.Value == TYPE_BOOL {
+		return boolValue(value != 0)
+	}
+	if c.Size >= 8 {
+		return value
+	}
+	bits := uint(c.Size * 8)
+	if c.Unsigned {
+		return value & (1<<bits - 1)
+	}
+	return value << (64 - bits) >> (64 - bits)
+}
+
+// maxValue returns the largest value representable by an integer type.
+func (c *Ctype) maxValue() uint64 {
+	bits := uint(c.Size * 8)
+	if c.Unsigned {
+		return 1<<bits - 1
+	}
+	return 1<<(bits-1) - 1
+}
+
+// align returns the alignment of a type: the size of a scalar and the
+// alignment of the elements of an array.
+func (c *Ctype) align() int {
+	if c.Value == TYPE_ARRAY {
+		return c.Ptrof.align()
+	}
+	return c.Size
 }
 
 var ctype_int = &Ctype{Value: TYPE_INT, Size: 4}
+var ctype_uint = &Ctype{Value: TYPE_INT, Size: 4, Unsigned: true}
 var ctype_char = &Ctype{Value: TYPE_CHAR, Size: 1}
+var ctype_uchar = &Ctype{Value: TYPE_CHAR, Size: 1, Unsigned: true}
+var ctype_bool = &Ctype{Value: TYPE_BOOL, Size: 1, Unsigned: true}
+var ctype_short = &Ctype{Value: TYPE_SHORT, Size: 2}
+var ctype_ushort = &Ctype{Value: TYPE_SHORT, Size: 2, Unsigned: true}
+
+// long long shares the representation of long on LP64, so both map here.
+var ctype_long = &Ctype{Value: TYPE_LONG, Size: 8}
+var ctype_ulong = &Ctype{Value: TYPE_LONG, Size: 8, Unsigned: true}
 
 type Visitor interface {
 	VisitInteger(n *Integer) (interface{}, error)
@@ -40,17 +102,27 @@ type Visitor interface {
 	VisitIf(n *If) (interface{}, error)
 	VisitFor(n *For) (interface{}, error)
 	VisitGoto(n *Goto) (interface{}, error)
+	VisitLabeledStatement(n *LabeledStatement) (interface{}, error)
 	VisitWhile(n *While) (interface{}, error)
+	VisitDoWhile(n *DoWhile) (interface{}, error)
+	VisitSwitch(n *Switch) (interface{}, error)
+	VisitCase(n *Case) (interface{}, error)
 	VisitBreak(n *Break) (interface{}, error)
 	VisitContinue(n *Continue) (interface{}, error)
 	VisitBlock(n *Block) (interface{}, error)
 	VisitVariableDeclaration(n *VariableDeclaration) (interface{}, error)
 	VisitUnaryOperator(n *UnaryOperatorNode) (interface{}, error)
 	VisitGlobalVariableDeclaration(m *GlobalVariableDeclaration) (interface{}, error)
+	VisitInitializerList(n *InitializerList) (interface{}, error)
+	VisitEmbed(n *Embed) (interface{}, error)
+	VisitCompoundAssignment(n *CompoundAssignment) (interface{}, error)
+	VisitConditional(n *Conditional) (interface{}, error)
 }
 
 type Integer struct {
+	Span
 	Value int
+	Ctype *Ctype
 }
 
 func (n *Integer) Accept(v Visitor) (interface{}, error) {
@@ -58,16 +130,23 @@ func (n *Integer) Accept(v Visitor) (interface{}, error) {
 }
 
 type Char struct {
+	Span
 	Value int
+	Ctype *Ctype
 }
 
 func (n *Char) Accept(v Visitor) (interface{}, error) {
 	return v.VisitChar(n)
 }
 
+// String is a string literal. Value holds the object representation of its
+// elements, which have type Ctype, and Index numbers it in the string pool.
 type String struct {
+	Span
 	Value string
 	Chars []*Char
+	Ctype *Ctype
+	Index int
 }
 
 func (n *String) Accept(v Visitor) (interface{}, error) {
@@ -75,17 +154,50 @@ func (n *String) Accept(v Visitor) (interface{}, error) {
 }
 
 type BinaryOperator struct {
+	Span
 	Ctype *Ctype
 	Type  int
 	Left  Node
 	Right Node
+	// OperandType is the type the operands are converted to, which for a
+	// shift is the promoted type of the left operand, nil when unknown.
+	OperandType *Ctype
 }
 
 func (n *BinaryOperator) Accept(v Visitor) (interface{}, error) {
 	return v.VisitBinaryOperator(n)
 }
 
+// CompoundAssignment is Left op= Right, where Type is the BinaryOperator
+// type of op. Left is evaluated once.
+type CompoundAssignment struct {
+	Span
+	Type  int
+	Left  Node
+	Right Node
+	// OperandType is the type the operation is carried out in, nil when
+	// unknown.
+	OperandType *Ctype
+}
+
+func (n *CompoundAssignment) Accept(v Visitor) (interface{}, error) {
+	return v.VisitCompoundAssignment(n)
+}
+
+// Conditional is the expression Condition ? Then : Else.
+type Conditional struct {
+	Span
+	Condition Node
+	Then      Node
+	Else      Node
+}
+
+func (n *Conditional) Accept(v Visitor) (interface{}, error) {
+	return v.VisitConditional(n)
+}
+
 type Call struct {
+	Span
 	Identifier string
 	Args       []Node
 }
@@ -95,6 +207,7 @@ func (n *Call) Accept(v Visitor) (interface{}, error) {
 }
 
 type Function struct {
+	Span
 	ReturnType *Ctype
 	Identifier string
 	Parameters []*Parameter
@@ -107,11 +220,13 @@ func (n *Function) Accept(v Visitor) (interface{}, error) {
 }
 
 type Parameter struct {
+	Span
 	Identifier string
 	Variable   *Variable
 }
 
 type Return struct {
+	Span
 	Expression Node
 }
 
@@ -120,6 +235,7 @@ func (n *Return) Accept(v Visitor) (interface{}, error) {
 }
 
 type Identifier struct {
+	Span
 	Value    string
 	Variable *Variable
 }
@@ -129,6 +245,7 @@ func (n *Identifier) Accept(v Visitor) (interface{}, error) {
 }
 
 type GlobalIdentifier struct {
+	Span
 	Value    string
 	Variable *Variable
 }
@@ -138,6 +255,7 @@ func (n *GlobalIdentifier) Accept(v Visitor) (interface{}, error) {
 }
 
 type UnaryOperatorNode struct {
+	Span
 	Type       int
 	Expression Node
 }
@@ -147,6 +265,7 @@ func (n *UnaryOperatorNode) Accept(v Visitor) (interface{}, error) {
 }
 
 type If struct {
+	Span
 	Expression     Node
 	IfStatements   Node
 	ElseStatements Node
@@ -157,6 +276,7 @@ func (n *If) Accept(v Visitor) (interface{}, error) {
 }
 
 type For struct {
+	Span
 	Init       Node
 	Expression Node
 	Update     Node
@@ -168,6 +288,7 @@ func (n *For) Accept(v Visitor) (interface{}, error) {
 }
 
 type While struct {
+	Span
 	Expression Node
 	Statements Node
 }
@@ -176,7 +297,48 @@ func (n *While) Accept(v Visitor) (interface{}, error) {
 	return v.VisitWhile(n)
 }
 
+type DoWhile struct {
+	Span
+	Statements Node
+	Expression Node
+}
+
+func (n *DoWhile) Accept(v Visitor) (interface{}, error) {
+	return v.VisitDoWhile(n)
+}
+
+// Switch is a switch statement. Cases are the case labels of its body in
+// source order; Default is nil without a default label. Ctype is the
+// promoted type of Expression, nil when unknown.
+type Switch struct {
+	Span
+	Ctype      *Ctype
+	Expression Node
+	Statements Node
+	Cases      []*Case
+	Default    *Case
+}
+
+func (n *Switch) Accept(v Visitor) (interface{}, error) {
+	return v.VisitSwitch(n)
+}
+
+// Case is a case or default label and the statement it labels. Label is
+// assigned by the generator.
+type Case struct {
+	Span
+	Value     int
+	Default   bool
+	Statement Node
+	Label     string
+}
+
+func (n *Case) Accept(v Visitor) (interface{}, error) {
+	return v.VisitCase(n)
+}
+
 type Goto struct {
+	Span
 	Label string
 }
 
@@ -184,19 +346,36 @@ func (n *Goto) Accept(v Visitor) (interface{}, error) {
 	return v.VisitGoto(n)
 }
 
-type Break struct{}
+// LabeledStatement is a statement with a label, which is a goto target
+// anywhere in its function.
+type LabeledStatement struct {
+	Span
+	Label     string
+	Statement Node
+}
+
+func (n *LabeledStatement) Accept(v Visitor) (interface{}, error) {
+	return v.VisitLabeledStatement(n)
+}
+
+type Break struct {
+	Span
+}
 
 func (n *Break) Accept(v Visitor) (interface{}, error) {
 	return v.VisitBreak(n)
 }
 
-type Continue struct{}
+type Continue struct {
+	Span
+}
 
 func (n *Continue) Accept(v Visitor) (interface{}, error) {
 	return v.VisitContinue(n)
 }
 
 type Block struct {
+	Span
 	Statements []Node
 }
 
@@ -204,12 +383,16 @@ func (n *Block) Accept(v Visitor) (interface{}, error) {
 	return v.VisitBlock(n)
 }
 
+// Variable is a local variable at (Index+1)*8 bytes below rbp, or a global.
+// Padding is the stack space left below a local to align it.
 type Variable struct {
-	Index int
-	Type  *Ctype
+	Index   int
+	Type    *Ctype
+	Padding int
 }
 
 type VariableDeclaration struct {
+	Span
 	Variable   *Variable
 	Identifier string
 	Expression Node
@@ -219,16 +402,45 @@ func (n *VariableDeclaration) Accept(v Visitor) (interface{}, error) {
 	return v.VisitVariableDeclaration(n)
 }
 
+// GlobalVariableDeclaration defines a global. Align is the alignment given
+// by _Alignas, or 0.
 type GlobalVariableDeclaration struct {
+	Span
 	Type       *Ctype
 	Identifier string
 	Expression Node
+	Align      int
 }
 
 func (n *GlobalVariableDeclaration) Accept(v Visitor) (interface{}, error) {
 	return v.VisitGlobalVariableDeclaration(n)
 }
 
+// InitializerList is the brace-enclosed initializer of an array of type
+// Ctype. Its elements are integer constants and #embed resources.
+type InitializerList struct {
+	Span
+	Ctype    *Ctype
+	Elements []Node
+}
+
+func (n *InitializerList) Accept(v Visitor) (interface{}, error) {
+	return v.VisitInitializerList(n)
+}
+
+// Embed initializes one element of type Ctype from each byte of a #embed
+// resource.
+type Embed struct {
+	Span
+	Ctype    *Ctype
+	Resource *Resource
+}
+
+func (n *Embed) Accept(v Visitor) (interface{}, error) {
+	return v.VisitEmbed(n)
+}
+
 type Node interface {
 	Accept(Visitor) (interface{}, error)
+	SourceSpan() Span
 }
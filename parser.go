@@ -1,21 +1,52 @@
 package main
 
-import "strconv"
+import (
+	"fmt"
+	"unicode/utf8"
+)
 
+// TokenSource produces the tokens of a translation unit on demand. After
+// the last one it returns TK_EOF on every call.
+type TokenSource interface {
+	Next() *Token
+}
+
+// Parser reads its tokens one at a time from a TokenSource, holding only
+// the current token, the one before it and at most one of lookahead.
 type Parser struct {
-	Index   int
-	Tokens  []*Token
-	LVars   map[string]*Variable
-	GVars   map[string]*Variable
-	Strings map[string]int
+	source   TokenSource
+	token    *Token
+	previous *Token
+	next     *Token
+	LVars    map[string]*Variable
+	GVars    map[string]*Variable
+	// Typedefs are the types named by file-scope typedef declarations.
+	Typedefs map[string]*Ctype
+	Strings  []*String
+	// Diagnostics are the errors found while parsing. After each one the
+	// parser skips to the end of the statement or declaration and goes on.
+	Diagnostics []Diagnostic
+	// Switch is the innermost switch statement, which takes the case
+	// labels.
+	Switch *Switch
+	// Labels are the labels defined in the current function and Gotos the
+	// labels its goto statements name. Labels have their own namespace,
+	// so a goto may jump forward to a label defined later.
+	Labels []*Token
+	Gotos  []*Token
+	// LoopDepth counts the loops around the statement being parsed, and
+	// BreakDepth the loops and switch statements.
+	LoopDepth  int
+	BreakDepth int
 }
 
-func NewParser(tokens []*Token) *Parser {
+func NewParser(source TokenSource) *Parser {
 	return &Parser{
-		Index:   0,
-		Tokens:  tokens,
-		GVars:   map[string]*Variable{},
-		Strings: map[string]int{},
+		source:   source,
+		token:    nextToken(source),
+		GVars:    map[string]*Variable{},
+		Typedefs: map[string]*Ctype{},
+		Strings:  []*String{},
 	}
 }
 
@@ -24,16 +55,42 @@ func (p *Parser) Parse() []Node {
 }
 
 func (p *Parser) current() *Token {
-	return p.Tokens[p.Index]
+	return p.token
 }
 
-func (p *Parser) consume(t int) *Token {
-	if len(p.Tokens) <= p.Index {
-		return nil
+// peek returns the token after the current one.
+func (p *Parser) peek() *Token {
+	if p.next == nil {
+		p.next = nextToken(p.source)
+	}
+	return p.next
+}
+
+// advance moves to the next token.
+func (p *Parser) advance() {
+	p.previous = p.token
+	if p.next != nil {
+		p.token, p.next = p.next, nil
+	} else {
+		p.token = nextToken(p.source)
 	}
+}
+
+// nextToken returns the next token of source, skipping the pragmas passed
+// on by the preprocessor, which only matter to -E output. A pragma may
+// appear between any two tokens.
+func nextToken(source TokenSource) *Token {
+	for {
+		if t := source.Next(); t.Type != TK_PRAGMA {
+			return t
+		}
+	}
+}
+
+func (p *Parser) consume(t int) *Token {
 	current := p.current()
 	if t == current.Type {
-		p.Index++
+		p.advance()
 		return current
 	}
 	return nil
@@ -51,6 +108,72 @@ func (p *Parser) repeat(t int) []*Token {
 	return tokens
 }
 
+// expect consumes a token of type t, or reports an error at the current
+// token and returns nil.
+func (p *Parser) expect(t int, format string, args ...interface{}) *Token {
+	if token := p.consume(t); token != nil {
+		return token
+	}
+	p.errorAt(p.current(), format, args...)
+	return nil
+}
+
+// expectSemicolon expects the ';' that ends a statement or declaration. The
+// error is reported just past the previous token, where the ';' belongs. A
+// ';' missing at the end of a line is taken as written, so the next line is
+// still parsed.
+func (p *Parser) expectSemicolon(format string, args ...interface{}) bool {
+	if token := p.consume(';'); token != nil {
+		return true
+	}
+	if p.previous == nil {
+		p.errorAt(p.current(), format, args...)
+		return false
+	}
+	d := tokenDiagnostic(p.previous, DIAG_ERROR, fmt.Sprintf(format, args...))
+	d.Offset, d.Line, d.Column = d.EndOffset, d.EndLine, d.EndColumn
+	p.Diagnostics = append(p.Diagnostics, d)
+	return p.previous != nil && p.current().Location().Line > p.previous.Location().EndLine
+}
+
+func (p *Parser) errorAt(t *Token, format string, args ...interface{}) {
+	p.Diagnostics = append(p.Diagnostics, tokenDiagnostic(t, DIAG_ERROR, fmt.Sprintf(format, args...)))
+}
+
+func (p *Parser) warningAt(t *Token, format string, args ...interface{}) {
+	p.Diagnostics = append(p.Diagnostics, tokenDiagnostic(t, DIAG_WARNING, fmt.Sprintf(format, args...)))
+}
+
+// synchronize skips the rest of a statement after an error: up to and
+// including the next ';' or block, or up to the '}' closing the enclosing
+// block.
+func (p *Parser) synchronize() {
+	depth := 0
+	for {
+		switch p.current().Type {
+		case TK_EOF:
+			return
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return
+			}
+			depth--
+			if depth == 0 {
+				p.advance()
+				return
+			}
+		case ';':
+			if depth == 0 {
+				p.advance()
+				return
+			}
+		}
+		p.advance()
+	}
+}
+
 func (p *Parser) declarations() []Node {
 	declarations := []Node{}
 	for {
@@ -58,9 +181,20 @@ func (p *Parser) declarations() []Node {
 			break
 		}
 		p.LVars = map[string]*Variable{}
+		if p.current().Type == TK_TYPEDEF {
+			if !p.typedef() {
+				p.synchronize()
+			}
+			continue
+		}
 		declaration := p.declaration()
 		if declaration == nil {
-			break
+			// a stray '}' is skipped alone, anything else up to the end of
+			// the declaration
+			if t := p.consume('}'); t == nil {
+				p.synchronize()
+			}
+			continue
 		}
 		declarations = append(declarations, declaration)
 	}
@@ -68,62 +202,337 @@ func (p *Parser) declarations() []Node {
 }
 
 func (p *Parser) declaration() Node {
-	ctype := p.ctype()
+	start := p.current()
+	var spec specifiers
+	ctype := p.declarationType(&spec)
 	if ctype == nil {
-		panic("cannot parse type")
+		return nil
 	}
-	ident := p.consume(TK_IDENT)
+	ident := p.expect(TK_IDENT, "expected identifier")
 	if ident == nil {
 		return nil
 	}
 	if p.current().Type == '(' {
-		if f := p.function(ctype, ident.Value); f != nil {
-			return f
+		if spec.Alignas != nil {
+			p.errorAt(spec.Alignas, "'_Alignas' attribute only applies to variables")
 		}
-	} else {
-		if t := p.consume(';'); t != nil {
-			_, ok := p.GVars[ident.Value]
-			if ok {
-				panic("variable redeclaration: " + ident.Value)
-			}
-			p.GVars[ident.Value] = &Variable{Type: ctype}
-			return &GlobalVariableDeclaration{
-				Type:       ctype,
-				Identifier: ident.Value,
-			}
-		}
-		token := p.consume('=')
-		if token == nil {
-			return nil
+		return p.function(start, ctype, ident.Value)
+	}
+	if spec.Noreturn != nil {
+		p.errorAt(spec.Noreturn, "'_Noreturn' can only appear on functions")
+	}
+	ctype = p.arrayDeclarator(ctype)
+	if ctype == nil || !p.checkAlignment(&spec, ctype) {
+		return nil
+	}
+	var exp Node
+	if t := p.consume('='); t != nil {
+		if ctype.Value == TYPE_ARRAY {
+			exp = p.initializerList(ctype)
+		} else {
+			exp = p.scalarInitializer(ctype)
 		}
-		exp := p.expression()
 		if exp == nil {
 			return nil
 		}
-		if colon := p.consume(';'); colon == nil {
+	} else if ctype.Value == TYPE_ARRAY && ctype.ArraySize < 0 {
+		p.errorAt(ident, "definition of variable '%s' with array type needs an explicit size or an initializer", ident.Value)
+	}
+	if !p.expectSemicolon("expected ';' after top level declarator") {
+		return nil
+	}
+	if _, ok := p.GVars[ident.Value]; ok {
+		p.errorAt(ident, "redefinition of '%s'", ident.Value)
+	}
+	p.GVars[ident.Value] = &Variable{Type: ctype}
+	return &GlobalVariableDeclaration{
+		Span:       p.spanFrom(start),
+		Type:       ctype,
+		Identifier: ident.Value,
+		Expression: exp,
+		Align:      spec.Align,
+	}
+}
+
+// arrayDeclarator parses the "[N]" or "[]" that makes a variable an array
+// of ctype. The size of "[]" is -1 until the initializer gives it.
+func (p *Parser) arrayDeclarator(ctype *Ctype) *Ctype {
+	if t := p.consume('['); t == nil {
+		return ctype
+	}
+	arraySize := -1
+	if num := p.consume(TK_NUMBER); num != nil {
+		size, _, err := parseIntegerLiteral(num.Value)
+		if err != nil {
+			p.errorAt(num, "%s", err)
 			return nil
 		}
-		_, ok := p.GVars[ident.Value]
-		if ok {
-			panic("variable redeclaration: " + ident.Value)
+		arraySize = int(size)
+	}
+	if t := p.expect(']', "expected ']'"); t == nil {
+		return nil
+	}
+	array := &Ctype{
+		Value:     TYPE_ARRAY,
+		Ptrof:     ctype,
+		ArraySize: arraySize,
+	}
+	if arraySize > 0 {
+		array.Size = arraySize * ctype.Size
+	}
+	return array
+}
+
+// initializerList parses the braced initializer of the array ctype, whose
+// elements are constant expressions and #embed resources. An array of
+// unknown size takes the number of elements.
+func (p *Parser) initializerList(ctype *Ctype) Node {
+	start := p.expect('{', "array initializer must be an initializer list")
+	if start == nil {
+		return nil
+	}
+	elements := []Node{}
+	count := 0
+	for p.consume('}') == nil {
+		if token := p.consume(TK_EMBED); token != nil {
+			elements = append(elements, &Embed{
+				Span:     token.Span,
+				Ctype:    ctype.Ptrof,
+				Resource: token.Resource,
+			})
+			count += len(token.Resource.Data)
+		} else {
+			first := p.current()
+			exp := p.assign()
+			if exp == nil {
+				return nil
+			}
+			value, ok := constantValue(exp)
+			if !ok {
+				p.errorAt(first, "initializer element is not constant")
+				return nil
+			}
+			elements = append(elements, &Integer{
+				Span:  exp.SourceSpan(),
+				Value: value,
+				Ctype: ctype.Ptrof,
+			})
+			count++
 		}
-		p.GVars[ident.Value] = &Variable{Type: ctype}
-		return &GlobalVariableDeclaration{
-			Type:       ctype,
-			Identifier: ident.Value,
-			Expression: exp,
+		if t := p.consume(','); t == nil {
+			if t := p.expect('}', "expected '}' after initializer list"); t == nil {
+				return nil
+			}
+			break
 		}
 	}
-	return nil
+	if ctype.ArraySize < 0 {
+		ctype.ArraySize = count
+		ctype.Size = count * ctype.Ptrof.Size
+	} else if count > ctype.ArraySize {
+		p.errorAt(start, "excess elements in array initializer")
+	}
+	return &InitializerList{
+		Span:     p.spanFrom(start),
+		Ctype:    ctype,
+		Elements: elements,
+	}
+}
+
+// scalarInitializer parses the initializer of a global of type ctype, a
+// constant expression folded to its value.
+func (p *Parser) scalarInitializer(ctype *Ctype) Node {
+	first := p.current()
+	exp := p.assign()
+	if exp == nil {
+		return nil
+	}
+	value, ok := constantValue(exp)
+	if !ok {
+		p.errorAt(first, "initializer element is not constant")
+		return nil
+	}
+	return &Integer{
+		Span:  exp.SourceSpan(),
+		Value: ctype.convert(value),
+		Ctype: ctype,
+	}
+}
+
+// constantValue folds an integer constant expression.
+func constantValue(n Node) (int, bool) {
+	value, _, ok := foldConstant(n)
+	return value, ok
+}
+
+// foldConstant folds an integer constant expression and returns its value
+// and type. Every operation is carried out in the type of the usual
+// arithmetic conversions of its operands, wrapping around to its width.
+// Division by zero and shifts by more than the width are not constant.
+func foldConstant(n Node) (int, *Ctype, bool) {
+	switch n := n.(type) {
+	case *Integer:
+		if n.Ctype == nil {
+			return n.Value, ctype_int, true
+		}
+		return n.Value, n.Ctype, true
+	case *Char:
+		if n.Ctype == nil {
+			return n.Value, ctype_int, true
+		}
+		return n.Value, n.Ctype, true
+	case *BinaryOperator:
+		l, lt, ok := foldConstant(n.Left)
+		if !ok {
+			return 0, nil, false
+		}
+		r, rt, ok := foldConstant(n.Right)
+		if !ok {
+			return 0, nil, false
+		}
+		return foldBinary(n.Type, l, lt, r, rt)
+	case *UnaryOperatorNode:
+		v, ctype, ok := foldConstant(n.Expression)
+		if !ok {
+			return 0, nil, false
+		}
+		switch n.Type {
+		case '~':
+			ctype = commonType(ctype, nil)
+			return ctype.convert(^v), ctype, true
+		case '!':
+			return boolValue(v == 0), ctype_int, true
+		}
+	case *Conditional:
+		c, _, ok := foldConstant(n.Condition)
+		if !ok {
+			return 0, nil, false
+		}
+		then, tt, ok := foldConstant(n.Then)
+		if !ok {
+			return 0, nil, false
+		}
+		otherwise, et, ok := foldConstant(n.Else)
+		if !ok {
+			return 0, nil, false
+		}
+		ctype := commonType(tt, et)
+		if c != 0 {
+			return ctype.convert(then), ctype, true
+		}
+		return ctype.convert(otherwise), ctype, true
+	}
+	return 0, nil, false
+}
+
+func foldBinary(op int, l int, lt *Ctype, r int, rt *Ctype) (int, *Ctype, bool) {
+	switch op {
+	case ND_LOGAND:
+		return boolValue(l != 0 && r != 0), ctype_int, true
+	case ND_LOGOR:
+		return boolValue(l != 0 || r != 0), ctype_int, true
+	case ND_LSHIFT, ND_RSHIFT:
+		ctype := commonType(lt, nil)
+		if r < 0 || r >= ctype.Size*8 {
+			return 0, nil, false
+		}
+		l = ctype.convert(l)
+		if op == ND_LSHIFT {
+			return ctype.convert(l << uint(r)), ctype, true
+		}
+		if ctype.Unsigned {
+			return int(uint64(l) >> uint(r)), ctype, true
+		}
+		return l >> uint(r), ctype, true
+	}
+
+	ctype := commonType(lt, rt)
+	l, r = ctype.convert(l), ctype.convert(r)
+	switch op {
+	case ND_EQUAL:
+		return boolValue(l == r), ctype_int, true
+	case ND_NOTEQUAL:
+		return boolValue(l != r), ctype_int, true
+	case '<', '>', ND_LE, ND_GE:
+		less := l < r
+		if ctype.Unsigned {
+			less = uint64(l) < uint64(r)
+		}
+		switch op {
+		case '<':
+			return boolValue(less), ctype_int, true
+		case '>':
+			return boolValue(!less && l != r), ctype_int, true
+		case ND_LE:
+			return boolValue(less || l == r), ctype_int, true
+		}
+		return boolValue(!less), ctype_int, true
+	case '/', '%':
+		if r == 0 {
+			return 0, nil, false
+		}
+		var v int
+		switch {
+		case ctype.Unsigned && op == '/':
+			v = int(uint64(l) / uint64(r))
+		case ctype.Unsigned:
+			v = int(uint64(l) % uint64(r))
+		case op == '/':
+			v = l / r
+		default:
+			v = l % r
+		}
+		return ctype.convert(v), ctype, true
+	}
+
+	var v int
+	switch op {
+	case '+':
+		v = l + r
+	case '-':
+		v = l - r
+	case '*':
+		v = l * r
+	case '&':
+		v = l & r
+	case '|':
+		v = l | r
+	case '^':
+		v = l ^ r
+	default:
+		return 0, nil, false
+	}
+	return ctype.convert(v), ctype, true
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// isTypeName reports whether the current token starts a type.
+func (p *Parser) isTypeName() bool {
+	t := p.current()
+	if t.Type == TK_IDENT {
+		_, ok := p.Typedefs[t.Value]
+		return ok
+	}
+	return typeSpecifiers[t.Type]
 }
 
 func (p *Parser) ctype() *Ctype {
-	typeNode := p.consume(TK_IDENT)
-	if typeNode == nil {
+	ctype := p.baseType()
+	if ctype == nil {
 		return nil
 	}
+	return p.pointers(ctype)
+}
+
+// pointers parses the '*'s that make ctype a pointer type.
+func (p *Parser) pointers(ctype *Ctype) *Ctype {
 	ptrs := p.repeat('*')
-	ctype := ctypeMap[typeNode.Value]
 	for i := 0; i < len(ptrs); i++ {
 		ctype = &Ctype{
 			Value: TYPE_PTR,
@@ -134,19 +543,230 @@ func (p *Parser) ctype() *Ctype {
 	return ctype
 }
 
-func (p *Parser) function(ctype *Ctype, ident string) Node {
-	if t := p.consume('('); t == nil {
+// specifiers are the function and alignment specifiers of a declaration.
+// Align is the strictest alignment given by _Alignas, or 0.
+type specifiers struct {
+	Noreturn *Token
+	Alignas  *Token
+	Align    int
+}
+
+// isDeclarationStart reports whether the current token starts a
+// declaration.
+func (p *Parser) isDeclarationStart() bool {
+	t := p.current().Type
+	return p.isTypeName() || t == TK_NORETURN || t == TK_ALIGNAS
+}
+
+// declarationType parses the type of a declaration. _Noreturn and _Alignas
+// may come before or after its type specifiers and are collected in spec.
+// It returns nil after an error.
+func (p *Parser) declarationType(spec *specifiers) *Ctype {
+	start := p.current()
+	if !p.specifiers(spec) {
+		return nil
+	}
+	ctype := p.baseType()
+	if ctype == nil {
+		p.errorAt(start, "expected declaration")
+		return nil
+	}
+	if !p.specifiers(spec) {
+		return nil
+	}
+	return p.pointers(ctype)
+}
+
+// specifiers parses any number of _Noreturn and _Alignas specifiers. The
+// operand of _Alignas is a type name or a constant expression, a power of
+// two or 0, which has no effect.
+func (p *Parser) specifiers(spec *specifiers) bool {
+	for {
+		if t := p.consume(TK_NORETURN); t != nil {
+			spec.Noreturn = t
+			continue
+		}
+		t := p.consume(TK_ALIGNAS)
+		if t == nil {
+			return true
+		}
+		if p.expect('(', "expected '(' after '_Alignas'") == nil {
+			return false
+		}
+		var align int
+		if p.isTypeName() {
+			ctype := p.typeName()
+			if ctype == nil {
+				return false
+			}
+			align = ctype.align()
+		} else {
+			first := p.current()
+			exp := p.conditional()
+			if exp == nil {
+				return false
+			}
+			value, ok := constantValue(exp)
+			if !ok {
+				p.errorAt(first, "expression is not an integer constant expression")
+				return false
+			}
+			if value < 0 || value&(value-1) != 0 {
+				p.errorAt(first, "requested alignment is not a positive power of 2")
+				return false
+			}
+			align = value
+		}
+		if p.expect(')', "expected ')'") == nil {
+			return false
+		}
+		spec.Alignas = t
+		if align > spec.Align {
+			spec.Align = align
+		}
+	}
+}
+
+// checkAlignment reports an _Alignas that would make ctype less strictly
+// aligned than it is, returning false.
+func (p *Parser) checkAlignment(spec *specifiers, ctype *Ctype) bool {
+	if spec.Align > 0 && spec.Align < ctype.align() {
+		p.errorAt(spec.Alignas, "requested alignment is less than minimum alignment of %d for type", ctype.align())
+		return false
+	}
+	return true
+}
+
+// typeName parses the type of an _Alignof or _Alignas operand, such
+// as int * or char [4].
+func (p *Parser) typeName() *Ctype {
+	start := p.current()
+	ctype := p.ctype()
+	if ctype == nil {
+		p.errorAt(start, "expected type")
+		return nil
+	}
+	return p.arrayDeclarator(ctype)
+}
+
+// baseType parses a typedef name or a list of type specifiers in any
+// order, such as long unsigned. An invalid combination is reported and
+// taken as int.
+func (p *Parser) baseType() *Ctype {
+	start := p.current()
+	if start.Type == TK_IDENT {
+		ctype, ok := p.Typedefs[start.Value]
+		if ok {
+			p.advance()
+		}
+		return ctype
+	}
+	count := map[int]int{}
+	for typeSpecifiers[p.current().Type] {
+		count[p.current().Type]++
+		p.advance()
+	}
+	if len(count) == 0 {
+		return nil
+	}
+	signed, unsigned := count[TK_SIGNED] > 0, count[TK_UNSIGNED] > 0
+	switch {
+	case signed && unsigned:
+		p.errorAt(start, "'signed' and 'unsigned' cannot be combined")
+		return ctype_int
+	case count[TK_LONG] > 2:
+		p.errorAt(start, "'long long long' is too long")
+		return ctype_int
+	case count[TK_SIGNED] > 1 || count[TK_UNSIGNED] > 1 || count[TK_CHAR] > 1 || count[TK_SHORT] > 1 || count[TK_INT] > 1,
+		count[TK_CHAR] > 0 && (count[TK_SHORT] > 0 || count[TK_LONG] > 0 || count[TK_INT] > 0),
+		count[TK_SHORT] > 0 && count[TK_LONG] > 0,
+		count[TK_BOOL] > 0 && len(count) > 1, count[TK_BOOL] > 1:
+		p.errorAt(start, "invalid combination of type specifiers")
+		return ctype_int
+	}
+	switch {
+	case count[TK_BOOL] > 0:
+		return ctype_bool
+	case count[TK_CHAR] > 0 && unsigned:
+		return ctype_uchar
+	case count[TK_CHAR] > 0:
+		return ctype_char
+	case count[TK_SHORT] > 0 && unsigned:
+		return ctype_ushort
+	case count[TK_SHORT] > 0:
+		return ctype_short
+	case count[TK_LONG] > 0 && unsigned:
+		return ctype_ulong
+	case count[TK_LONG] > 0:
+		return ctype_long
+	case unsigned:
+		return ctype_uint
+	}
+	return ctype_int
+}
+
+func sameType(a *Ctype, b *Ctype) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Value == b.Value && a.Size == b.Size && a.Unsigned == b.Unsigned &&
+		a.ArraySize == b.ArraySize && sameType(a.Ptrof, b.Ptrof)
+}
+
+// typedef parses a file-scope typedef declaration, returning false after
+// an error.
+func (p *Parser) typedef() bool {
+	p.consume(TK_TYPEDEF)
+	start := p.current()
+	ctype := p.ctype()
+	if ctype == nil {
+		p.errorAt(start, "expected type")
+		return false
+	}
+	ident := p.expect(TK_IDENT, "expected identifier")
+	if ident == nil {
+		return false
+	}
+	if ctype = p.arrayDeclarator(ctype); ctype == nil {
+		return false
+	}
+	if !p.expectSemicolon("expected ';' after typedef") {
+		return false
+	}
+	if previous, ok := p.Typedefs[ident.Value]; ok && !sameType(previous, ctype) {
+		p.errorAt(ident, "typedef redefinition with different types")
+	}
+	if _, ok := p.GVars[ident.Value]; ok {
+		p.errorAt(ident, "redefinition of '%s' as different kind of symbol", ident.Value)
+	}
+	p.Typedefs[ident.Value] = ctype
+	return true
+}
+
+func (p *Parser) function(start *Token, ctype *Ctype, ident string) Node {
+	if t := p.expect('(', "expected '('"); t == nil {
 		return nil
 	}
 	params := p.parameters()
-	if t := p.consume(')'); t == nil {
+	if params == nil {
+		return nil
+	}
+	if t := p.expect(')', "expected ')'"); t == nil {
+		return nil
+	}
+	if p.current().Type != '{' {
+		p.errorAt(p.current(), "expected function body after function declarator")
 		return nil
 	}
+	p.Labels = nil
+	p.Gotos = nil
 	block := p.block()
 	if block == nil {
 		return nil
 	}
+	p.checkLabels()
 	return &Function{
+		Span:       p.spanFrom(start),
 		ReturnType: ctype,
 		Identifier: ident,
 		Parameters: params,
@@ -155,145 +775,172 @@ func (p *Parser) function(ctype *Ctype, ident string) Node {
 	}
 }
 
+// checkLabels reports the gotos to labels not defined in the function and
+// the labels no goto uses.
+func (p *Parser) checkLabels() {
+	used := map[string]bool{}
+	for _, t := range p.Gotos {
+		used[t.Value] = true
+		if p.findLabel(t.Value) == nil {
+			p.errorAt(t, "use of undeclared label '%s'", t.Value)
+		}
+	}
+	for _, t := range p.Labels {
+		if !used[t.Value] {
+			p.warningAt(t, "unused label '%s'", t.Value)
+		}
+	}
+}
+
+func (p *Parser) findLabel(name string) *Token {
+	for _, t := range p.Labels {
+		if t.Value == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// parameters parses a parameter list, returning nil after an error.
 func (p *Parser) parameters() []*Parameter {
 	parameters := []*Parameter{}
+	if p.current().Type == ')' {
+		return parameters
+	}
 	for {
 		parameter := p.parameter()
 		if parameter == nil {
-			break
+			return nil
 		}
 		parameters = append(parameters, parameter)
 		if token := p.consume(','); token == nil {
-			break
+			return parameters
 		}
 	}
-	return parameters
 }
 
 func (p *Parser) parameter() *Parameter {
-	typeNode := p.consume(TK_IDENT)
-	if typeNode == nil {
+	start := p.current()
+	ctype := p.ctype()
+	if ctype == nil {
+		p.errorAt(start, "expected parameter declarator")
 		return nil
 	}
-	ident := p.consume(TK_IDENT)
+	ident := p.expect(TK_IDENT, "expected identifier")
 	if ident == nil {
 		return nil
 	}
-	v := p.createLocalVariable(ctypeMap[typeNode.Value])
+	if _, ok := p.LVars[ident.Value]; ok {
+		p.errorAt(ident, "redefinition of parameter '%s'", ident.Value)
+	}
+	v := p.createLocalVariable(ctype, 0)
 	p.LVars[ident.Value] = v
 	return &Parameter{
+		Span:       p.spanFrom(start),
 		Variable:   v,
 		Identifier: ident.Value,
 	}
 }
 
+// statements parses the statements of a block up to its '}'. A statement
+// with an error is reported and skipped.
 func (p *Parser) statements() []Node {
 	statements := []Node{}
 	for {
+		if t := p.current().Type; t == '}' || t == TK_EOF {
+			return statements
+		}
 		statement := p.statement()
 		if statement == nil {
-			break
+			p.synchronize()
+			continue
 		}
 		statements = append(statements, statement)
 	}
-	return statements
 }
 
+// statement parses a statement chosen by its first token. It returns nil
+// after reporting an error.
 func (p *Parser) statement() Node {
-	if stmt := p.try(p.block); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.expressionStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.returnStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.ifStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.whileStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.forStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.continueStatement); stmt != nil {
-		return stmt
-	}
-
-	if stmt := p.try(p.breakStatement); stmt != nil {
-		return stmt
+	switch p.current().Type {
+	case ';':
+		// a null statement does nothing, like an empty block
+		return &Block{Span: p.consume(';').Span}
+	case '{':
+		return p.block()
+	case TK_RETURN:
+		return p.returnStatement()
+	case TK_IF:
+		return p.ifStatement()
+	case TK_WHILE:
+		return p.whileStatement()
+	case TK_DO:
+		return p.doWhileStatement()
+	case TK_FOR:
+		return p.forStatement()
+	case TK_SWITCH:
+		return p.switchStatement()
+	case TK_CASE, TK_DEFAULT:
+		return p.caseStatement()
+	case TK_GOTO:
+		return p.gotoStatement()
+	case TK_IDENT:
+		if p.peek().Type == ':' {
+			return p.labeledStatement()
+		}
+	case TK_CONTINUE:
+		return p.continueStatement()
+	case TK_BREAK:
+		return p.breakStatement()
 	}
-
-	if stmt := p.try(p.variableDeclarationStatement); stmt != nil {
-		return stmt
+	if p.isDeclarationStart() {
+		return p.variableDeclarationStatement()
 	}
-	return nil
+	return p.expressionStatement()
 }
 
 func (p *Parser) variableDeclarationStatement() Node {
-	ctype := p.ctype()
+	start := p.current()
+	var spec specifiers
+	ctype := p.declarationType(&spec)
 	if ctype == nil {
 		return nil
 	}
-	ident := p.consume(TK_IDENT)
+	if spec.Noreturn != nil {
+		p.errorAt(spec.Noreturn, "'_Noreturn' can only appear on functions")
+	}
+	ident := p.expect(TK_IDENT, "expected identifier")
 	if ident == nil {
 		return nil
 	}
-	if t := p.consume('['); t != nil {
-		if num := p.consume(TK_NUMBER); num != nil {
-			if t := p.consume(']'); t != nil {
-				arraySize, err := strconv.Atoi(num.Value)
-				if err != nil {
-					panic(err)
-				}
-				ctype = &Ctype{
-					Value:     TYPE_ARRAY,
-					Ptrof:     ctype,
-					Size:      arraySize * ctype.Size,
-					ArraySize: arraySize,
-				}
-			}
-		}
-	}
-	if colon := p.consume(';'); colon != nil {
-		_, ok := p.LVars[ident.Value]
-		if ok {
-			panic("variable redeclaration: " + ident.Value)
-		}
-		v := p.createLocalVariable(ctype)
-		p.LVars[ident.Value] = v
-		return &VariableDeclaration{
-			Variable:   v,
-			Identifier: ident.Value,
-			Expression: nil,
-		}
+	ctype = p.arrayDeclarator(ctype)
+	if ctype == nil || !p.checkAlignment(&spec, ctype) {
+		return nil
 	}
-	token := p.consume('=')
-	if token == nil {
+	if spec.Align > STACK_ALIGN {
+		p.errorAt(spec.Alignas, "requested alignment %d is larger than the stack alignment of %d", spec.Align, STACK_ALIGN)
 		return nil
 	}
-	exp := p.expression()
-	if exp == nil {
+	if ctype.Value == TYPE_ARRAY && ctype.ArraySize < 0 {
+		p.errorAt(ident, "definition of variable '%s' with array type needs an explicit size", ident.Value)
 		return nil
 	}
-	if colon := p.consume(';'); colon == nil {
+	var exp Node
+	if t := p.consume('='); t != nil {
+		if exp = p.expression(); exp == nil {
+			return nil
+		}
+	}
+	if !p.expectSemicolon("expected ';' at end of declaration") {
 		return nil
 	}
-	_, ok := p.LVars[ident.Value]
-	if ok {
-		panic("variable redeclaration: " + ident.Value)
+	if _, ok := p.LVars[ident.Value]; ok {
+		p.errorAt(ident, "redefinition of '%s'", ident.Value)
 	}
-	v := p.createLocalVariable(ctype)
+	v := p.createLocalVariable(ctype, spec.Align)
 	p.LVars[ident.Value] = v
 	return &VariableDeclaration{
+		Span:       p.spanFrom(start),
 		Variable:   v,
 		Identifier: ident.Value,
 		Expression: exp,
@@ -301,491 +948,1107 @@ func (p *Parser) variableDeclarationStatement() Node {
 }
 
 func (p *Parser) ifStatement() Node {
-	if t := p.consume(TK_IF); t == nil {
+	start := p.consume(TK_IF)
+	if t := p.expect('(', "expected '(' after 'if'"); t == nil {
 		return nil
 	}
-	if t := p.consume('('); t == nil {
+	expression := p.expression()
+	if expression == nil {
 		return nil
 	}
-	expression := p.expression()
-	if t := p.consume(')'); t == nil {
+	if t := p.expect(')', "expected ')'"); t == nil {
 		return nil
 	}
 	stmt := p.statement()
 	if stmt == nil {
 		return nil
 	}
+	// an else belongs to the innermost if, which has already taken it
+	var elseStmt Node
+	if t := p.consume(TK_ELSE); t != nil {
+		if elseStmt = p.statement(); elseStmt == nil {
+			return nil
+		}
+	}
 	return &If{
+		Span:           p.spanFrom(start),
 		Expression:     expression,
 		IfStatements:   stmt,
-		ElseStatements: nil,
+		ElseStatements: elseStmt,
 	}
 }
 
-func (p *Parser) breakStatement() Node {
-	if t := p.consume(TK_BREAK); t == nil {
+func (p *Parser) switchStatement() Node {
+	start := p.consume(TK_SWITCH)
+	if t := p.expect('(', "expected '(' after 'switch'"); t == nil {
 		return nil
 	}
-	if colon := p.consume(';'); colon == nil {
+	expression := p.expression()
+	if expression == nil {
 		return nil
 	}
-	return &Break{}
-}
-
-func (p *Parser) continueStatement() Node {
-	if t := p.consume(TK_CONTINUE); t == nil {
+	if t := p.expect(')', "expected ')'"); t == nil {
 		return nil
 	}
-	if colon := p.consume(';'); colon == nil {
+	node := &Switch{Ctype: commonType(operandType(expression), nil), Expression: expression}
+	outer := p.Switch
+	p.Switch = node
+	p.BreakDepth++
+	stmt := p.statement()
+	p.BreakDepth--
+	p.Switch = outer
+	if stmt == nil {
 		return nil
 	}
-	return &Continue{}
+	node.Span = p.spanFrom(start)
+	node.Statements = stmt
+	return node
 }
 
-func (p *Parser) whileStatement() Node {
-	if t := p.consume(TK_WHILE); t == nil {
+// caseStatement parses a case or default label and the statement following
+// it, and adds the label to the enclosing switch.
+func (p *Parser) caseStatement() Node {
+	start := p.current()
+	p.advance()
+	node := &Case{Default: start.Type == TK_DEFAULT}
+	if !node.Default {
+		first := p.current()
+		exp := p.conditional()
+		if exp == nil {
+			return nil
+		}
+		value, ok := constantValue(exp)
+		if !ok {
+			p.errorAt(first, "expression is not an integer constant expression")
+			return nil
+		}
+		node.Value = value
+		if p.Switch != nil {
+			node.Value = convertCaseValue(value, p.Switch.Ctype)
+		}
+	}
+	if t := p.expect(':', "expected ':' after '%s'", start.Value); t == nil {
 		return nil
 	}
-	if t := p.consume('('); t == nil {
+	switch {
+	case p.Switch == nil:
+		p.errorAt(start, "'%s' statement not in switch statement", start.Value)
+	case node.Default && p.Switch.Default != nil:
+		p.errorAt(start, "multiple default labels in one switch")
+	case node.Default:
+		p.Switch.Default = node
+	default:
+		for _, c := range p.Switch.Cases {
+			if c.Value == node.Value {
+				p.errorAt(start, "duplicate case value '%d'", node.Value)
+				break
+			}
+		}
+		p.Switch.Cases = append(p.Switch.Cases, node)
+	}
+	stmt := p.statement()
+	if stmt == nil {
 		return nil
 	}
-	expression := p.expression()
-	if t := p.consume(')'); t == nil {
+	node.Span = p.spanFrom(start)
+	node.Statement = stmt
+	return node
+}
+
+// convertCaseValue converts a case value to the promoted type of the switch
+// expression, which is at least as wide as int.
+func convertCaseValue(value int, ctype *Ctype) int {
+	if ctype == nil {
+		return value
+	}
+	if ctype.Size < 4 {
+		ctype = ctype_int
+	}
+	return ctype.convert(value)
+}
+
+func (p *Parser) gotoStatement() Node {
+	start := p.consume(TK_GOTO)
+	label := p.expect(TK_IDENT, "expected identifier")
+	if label == nil {
+		return nil
+	}
+	if !p.expectSemicolon("expected ';' after goto statement") {
 		return nil
 	}
+	p.Gotos = append(p.Gotos, label)
+	return &Goto{Span: p.spanFrom(start), Label: label.Value}
+}
+
+func (p *Parser) labeledStatement() Node {
+	label := p.consume(TK_IDENT)
+	p.consume(':')
+	if previous := p.findLabel(label.Value); previous != nil {
+		d := tokenDiagnostic(label, DIAG_ERROR, fmt.Sprintf("redefinition of label '%s'", label.Value))
+		d.Notes = append(d.Notes, tokenDiagnostic(previous, DIAG_NOTE, "previous definition is here"))
+		p.Diagnostics = append(p.Diagnostics, d)
+	} else {
+		p.Labels = append(p.Labels, label)
+	}
 	stmt := p.statement()
 	if stmt == nil {
 		return nil
 	}
-	return &While{
-		Expression: expression,
-		Statements: stmt,
+	return &LabeledStatement{
+		Span:      p.spanFrom(label),
+		Label:     label.Value,
+		Statement: stmt,
 	}
 }
 
-func (p *Parser) forStatement() Node {
-	if t := p.consume(TK_FOR); t == nil {
+func (p *Parser) breakStatement() Node {
+	start := p.consume(TK_BREAK)
+	if p.BreakDepth == 0 {
+		p.errorAt(start, "'break' statement not in loop or switch statement")
+	}
+	if !p.expectSemicolon("expected ';' after break statement") {
 		return nil
 	}
-	if t := p.consume('('); t == nil {
+	return &Break{Span: p.spanFrom(start)}
+}
+
+func (p *Parser) continueStatement() Node {
+	start := p.consume(TK_CONTINUE)
+	if p.LoopDepth == 0 {
+		p.errorAt(start, "'continue' statement not in loop statement")
+	}
+	if !p.expectSemicolon("expected ';' after continue statement") {
 		return nil
 	}
-	init := p.variableDeclarationStatement()
-	if init == nil {
-		init = p.expressionStatement()
+	return &Continue{Span: p.spanFrom(start)}
+}
+
+// loopBody parses the statement of a loop, in which break and continue
+// are allowed.
+func (p *Parser) loopBody() Node {
+	p.LoopDepth++
+	p.BreakDepth++
+	stmt := p.statement()
+	p.LoopDepth--
+	p.BreakDepth--
+	return stmt
+}
+
+func (p *Parser) whileStatement() Node {
+	start := p.consume(TK_WHILE)
+	if t := p.expect('(', "expected '(' after 'while'"); t == nil {
+		return nil
 	}
-	exp := p.expression()
-	if t := p.consume(';'); t == nil {
+	expression := p.expression()
+	if expression == nil {
 		return nil
 	}
-	update := p.expression()
-	if t := p.consume(')'); t == nil {
+	if t := p.expect(')', "expected ')'"); t == nil {
 		return nil
 	}
-	stmt := p.statement()
+	stmt := p.loopBody()
 	if stmt == nil {
 		return nil
 	}
-	return &For{
-		Init:       init,
-		Expression: exp,
-		Update:     update,
+	return &While{
+		Span:       p.spanFrom(start),
+		Expression: expression,
 		Statements: stmt,
 	}
 }
 
-func (p *Parser) block() Node {
-	if t := p.consume('{'); t == nil {
+func (p *Parser) doWhileStatement() Node {
+	start := p.consume(TK_DO)
+	stmt := p.loopBody()
+	if stmt == nil {
 		return nil
 	}
-	statements := p.statements()
-	if statements == nil {
+	if t := p.expect(TK_WHILE, "expected 'while' in do/while loop"); t == nil {
 		return nil
 	}
-	if t := p.consume('}'); t == nil {
+	if t := p.expect('(', "expected '(' after 'while'"); t == nil {
 		return nil
 	}
-	return &Block{
-		Statements: statements,
+	expression := p.expression()
+	if expression == nil {
+		return nil
+	}
+	if t := p.expect(')', "expected ')'"); t == nil {
+		return nil
+	}
+	if !p.expectSemicolon("expected ';' after do/while statement") {
+		return nil
+	}
+	return &DoWhile{
+		Span:       p.spanFrom(start),
+		Statements: stmt,
+		Expression: expression,
 	}
 }
 
-func (p *Parser) arrayExpression() Node {
-	left := p.callExpression()
-	if left == nil {
+func (p *Parser) forStatement() Node {
+	start := p.consume(TK_FOR)
+	if t := p.expect('(', "expected '(' after 'for'"); t == nil {
 		return nil
 	}
-	if t := p.consume('['); t == nil {
+	// every clause may be omitted; a missing condition is always true
+	var init Node
+	switch {
+	case p.consume(';') != nil:
+	case p.isTypeName():
+		if init = p.variableDeclarationStatement(); init == nil {
+			return nil
+		}
+	default:
+		if init = p.expressionStatement(); init == nil {
+			return nil
+		}
+	}
+	var exp Node
+	if p.current().Type != ';' {
+		if exp = p.expression(); exp == nil {
+			return nil
+		}
+	}
+	if t := p.expect(';', "expected ';' in 'for' statement specifier"); t == nil {
 		return nil
 	}
-	right := p.callExpression()
-	if right == nil {
+	var update Node
+	if p.current().Type != ')' {
+		if update = p.expression(); update == nil {
+			return nil
+		}
+	}
+	if t := p.expect(')', "expected ')'"); t == nil {
 		return nil
 	}
-	if t := p.consume(']'); t == nil {
+	stmt := p.loopBody()
+	if stmt == nil {
 		return nil
 	}
-	return &UnaryOperatorNode{
-		Type: '*',
-		Expression: &BinaryOperator{
-			Type:  '+',
-			Left:  left,
-			Right: right,
-			Ctype: p.getCtype(left, right),
-		},
+	return &For{
+		Span:       p.spanFrom(start),
+		Init:       init,
+		Expression: exp,
+		Update:     update,
+		Statements: stmt,
 	}
 }
 
-func (p *Parser) returnStatement() Node {
-	if ret := p.consume(TK_RETURN); ret == nil {
+func (p *Parser) block() Node {
+	start := p.consume('{')
+	statements := p.statements()
+	if t := p.expect('}', "expected '}'"); t == nil {
 		return nil
 	}
+	return &Block{
+		Span:       p.spanFrom(start),
+		Statements: statements,
+	}
+}
+
+func (p *Parser) returnStatement() Node {
+	start := p.consume(TK_RETURN)
 	exp := p.expression()
 	if exp == nil {
 		return nil
 	}
-	if colon := p.consume(';'); colon == nil {
+	if !p.expectSemicolon("expected ';' after return statement") {
 		return nil
 	}
 	return &Return{
+		Span:       p.spanFrom(start),
 		Expression: exp,
 	}
 }
 
 func (p *Parser) expressionStatement() Node {
-	exp := p.try(p.assignExpression)
+	exp := p.expression()
 	if exp == nil {
-		exp = p.callExpression()
-		if exp == nil {
-			return nil
-		}
+		return nil
 	}
-	if colon := p.consume(';'); colon == nil {
+	if !p.expectSemicolon("expected ';' after expression") {
 		return nil
 	}
 	return exp
 }
 
+// binaryPrecedence gives the precedence of the binary operators parsed by
+// precedence climbing, from || (1) up to the multiplicative operators (10).
+// All of them are left associative.
+var binaryPrecedence = map[int]int{
+	TK_LOGOR:    1,
+	TK_LOGAND:   2,
+	'|':         3,
+	'^':         4,
+	'&':         5,
+	TK_EQUAL:    6,
+	TK_NOTEQUAL: 6,
+	'<':         7,
+	'>':         7,
+	TK_LE:       7,
+	TK_GE:       7,
+	TK_LSHIFT:   8,
+	TK_RSHIFT:   8,
+	'+':         9,
+	'-':         9,
+	'*':         10,
+	'/':         10,
+	'%':         10,
+}
+
+// binaryNodeTypes maps operator tokens to BinaryOperator types where they
+// differ.
+var binaryNodeTypes = map[int]int{
+	TK_LOGOR:    ND_LOGOR,
+	TK_LOGAND:   ND_LOGAND,
+	TK_EQUAL:    ND_EQUAL,
+	TK_NOTEQUAL: ND_NOTEQUAL,
+	TK_LE:       ND_LE,
+	TK_GE:       ND_GE,
+	TK_LSHIFT:   ND_LSHIFT,
+	TK_RSHIFT:   ND_RSHIFT,
+}
+
+// compoundAssignments maps the compound assignment operators to the
+// operation they apply.
+var compoundAssignments = map[int]int{
+	TK_MUL_ASSIGN:    '*',
+	TK_DIV_ASSIGN:    '/',
+	TK_MOD_ASSIGN:    '%',
+	TK_ADD_ASSIGN:    '+',
+	TK_SUB_ASSIGN:    '-',
+	TK_LSHIFT_ASSIGN: ND_LSHIFT,
+	TK_RSHIFT_ASSIGN: ND_RSHIFT,
+	TK_AND_ASSIGN:    '&',
+	TK_XOR_ASSIGN:    '^',
+	TK_OR_ASSIGN:     '|',
+}
+
+// expression parses an expression including the comma operator.
 func (p *Parser) expression() Node {
-	if assign := p.try(p.assignExpression); assign != nil {
-		return assign
+	node := p.assign()
+	if node == nil {
+		return nil
 	}
-	if exp := p.try(p.add); exp != nil {
-		return exp
+	for p.consume(',') != nil {
+		right := p.assign()
+		if right == nil {
+			return nil
+		}
+		node = &BinaryOperator{
+			Span:  joinSpan(node.SourceSpan(), right.SourceSpan()),
+			Type:  ',',
+			Left:  node,
+			Right: right,
+			Ctype: expressionType(right),
+		}
 	}
-	return nil
+	return node
 }
 
-func (p *Parser) assignExpression() Node {
-	var left Node
-	if left = p.try(p.arrayExpression); left == nil {
-		if left = p.try(p.pointerExpression); left == nil {
-			ident := p.consume(TK_IDENT)
-			if ident == nil {
-				return nil
-			}
-			left = p.lookup(ident.Value)
-		}
+// assign parses an assignment or an expression of lower precedence.
+// Assignment is right associative.
+func (p *Parser) assign() Node {
+	left := p.conditional()
+	if left == nil {
+		return nil
+	}
+	token := p.current()
+	op, compound := compoundAssignments[token.Type]
+	if token.Type != '=' && !compound {
+		return left
 	}
-	token := p.consume('=')
-	if token == nil {
+	p.advance()
+	if !isLvalue(left) {
+		p.errorAt(token, "expression is not assignable")
 		return nil
 	}
-	right := p.expression()
+	right := p.assign()
 	if right == nil {
 		return nil
 	}
+	span := joinSpan(left.SourceSpan(), right.SourceSpan())
+	if compound {
+		return &CompoundAssignment{
+			Span:        span,
+			Type:        op,
+			Left:        left,
+			Right:       right,
+			OperandType: arithmeticType(op, left, right),
+		}
+	}
 	return &BinaryOperator{
+		Span:  span,
 		Type:  token.Type,
 		Left:  left,
 		Right: right,
-		Ctype: p.getCtype(left, right),
+		Ctype: expressionType(left),
 	}
 }
 
-func (p *Parser) add() Node {
-	node := p.booleanExpression()
-	if next := p.consume('+'); next != nil {
-		right := p.add()
-		return &BinaryOperator{
-			Type:  next.Type,
-			Left:  node,
-			Right: right,
-			Ctype: p.getCtype(node, right),
-		}
+// isLvalue reports whether n designates an object that can be assigned.
+func isLvalue(n Node) bool {
+	switch n := n.(type) {
+	case *Identifier, *GlobalIdentifier:
+		return true
+	case *UnaryOperatorNode:
+		return n.Type == '*'
+	}
+	return false
+}
+
+// conditional parses the ?: operator, which is right associative.
+func (p *Parser) conditional() Node {
+	condition := p.binary(1)
+	if condition == nil {
+		return nil
 	}
-	if next := p.consume('-'); next != nil {
-		right := p.add()
-		return &BinaryOperator{
-			Type:  next.Type,
-			Left:  node,
-			Right: right,
-			Ctype: p.getCtype(node, right),
-		}
+	if t := p.consume('?'); t == nil {
+		return condition
+	}
+	then := p.expression()
+	if then == nil {
+		return nil
+	}
+	if t := p.expect(':', "expected ':'"); t == nil {
+		return nil
+	}
+	otherwise := p.conditional()
+	if otherwise == nil {
+		return nil
+	}
+	return &Conditional{
+		Span:      joinSpan(condition.SourceSpan(), otherwise.SourceSpan()),
+		Condition: condition,
+		Then:      then,
+		Else:      otherwise,
 	}
-	return node
 }
 
-func (p *Parser) booleanExpression() Node {
-	node := p.mul()
-	if next := p.consume(TK_EQUAL); next != nil {
-		return &BinaryOperator{
-			Type:  ND_EQUAL,
-			Left:  node,
-			Right: p.booleanExpression(),
-		}
+// binary parses binary operators of precedence minPrecedence or higher by
+// precedence climbing.
+func (p *Parser) binary(minPrecedence int) Node {
+	left := p.unary()
+	if left == nil {
+		return nil
 	}
-	if next := p.consume(TK_NOTEQUAL); next != nil {
-		return &BinaryOperator{
-			Type:  ND_NOTEQUAL,
-			Left:  node,
-			Right: p.booleanExpression(),
+	for {
+		op := p.current()
+		precedence, ok := binaryPrecedence[op.Type]
+		if !ok || precedence < minPrecedence {
+			return left
+		}
+		p.advance()
+		right := p.binary(precedence + 1)
+		if right == nil {
+			return nil
+		}
+		ty, ok := binaryNodeTypes[op.Type]
+		if !ok {
+			ty = op.Type
+		}
+		var ctype, operandType *Ctype
+		if ty != ND_LOGAND && ty != ND_LOGOR {
+			operandType = arithmeticType(ty, left, right)
+		}
+		switch ty {
+		case '+', '-':
+			ctype = additiveType(ty, left, right, operandType)
+		case '<', '>', ND_LE, ND_GE, ND_EQUAL, ND_NOTEQUAL, ND_LOGAND, ND_LOGOR:
+			ctype = ctype_int
+		default:
+			ctype = operandType
+		}
+		left = &BinaryOperator{
+			Span:        joinSpan(left.SourceSpan(), right.SourceSpan()),
+			Type:        ty,
+			Left:        left,
+			Right:       right,
+			Ctype:       ctype,
+			OperandType: operandType,
 		}
 	}
-	return node
 }
 
-func (p *Parser) mul() Node {
-	node := p.unary()
-	if next := p.consume('*'); next != nil {
-		return &BinaryOperator{
-			Type:  next.Type,
-			Left:  node,
-			Right: p.mul(),
+// arithmeticType returns the type the operands of a binary operator are
+// converted to, which decides between signed and unsigned instructions.
+// A shift takes the promoted type of its left operand alone.
+func arithmeticType(op int, left Node, right Node) *Ctype {
+	if op == ND_LSHIFT || op == ND_RSHIFT {
+		return commonType(operandType(left), nil)
+	}
+	return commonType(operandType(left), operandType(right))
+}
+
+// operandType returns the type of an operand of an arithmetic operator or
+// comparison, nil when unknown. Pointers compare as unsigned addresses.
+func operandType(n Node) *Ctype {
+	ctype := expressionType(n)
+	if isPointer(ctype) {
+		return ctype_ulong
+	}
+	return ctype
+}
+
+func isPointer(ctype *Ctype) bool {
+	return ctype != nil && (ctype.Value == TYPE_PTR || ctype.Value == TYPE_ARRAY)
+}
+
+// additiveType returns the type of the result of + or -: the pointer or
+// array operand for pointer arithmetic, long for the difference of two
+// pointers and otherwise the converted type of the operands.
+func additiveType(op int, left Node, right Node, operandType *Ctype) *Ctype {
+	lt, rt := expressionType(left), expressionType(right)
+	switch {
+	case isPointer(lt) && isPointer(rt) && op == '-':
+		return ctype_long
+	case isPointer(lt):
+		return lt
+	case isPointer(rt) && op == '+':
+		return rt
+	}
+	return operandType
+}
+
+// expressionType returns the type of an expression, nil when unknown.
+// Arithmetic operators have the type of the usual arithmetic conversions
+// of their operands, which the parser records on each node.
+func expressionType(n Node) *Ctype {
+	switch n := n.(type) {
+	case *Identifier:
+		return n.Variable.Type
+	case *GlobalIdentifier:
+		return n.Variable.Type
+	case *Integer:
+		return n.Ctype
+	case *Char:
+		return n.Ctype
+	case *BinaryOperator:
+		return n.Ctype
+	case *CompoundAssignment:
+		return expressionType(n.Left)
+	case *Conditional:
+		then, otherwise := expressionType(n.Then), expressionType(n.Else)
+		if isPointer(then) {
+			return then
+		}
+		if isPointer(otherwise) {
+			return otherwise
+		}
+		return commonType(then, otherwise)
+	case *UnaryOperatorNode:
+		ctype := expressionType(n.Expression)
+		switch n.Type {
+		case '~':
+			return commonType(ctype, nil)
+		case '!':
+			return ctype_int
+		case '*':
+			if isPointer(ctype) {
+				return ctype.Ptrof
+			}
+		case '&':
+			if ctype != nil {
+				return &Ctype{Value: TYPE_PTR, Ptrof: ctype, Size: 8}
+			}
+		case ND_POSTINC, ND_POSTDEC:
+			return ctype
 		}
 	}
-	if next := p.consume('-'); next != nil {
-		return &BinaryOperator{
-			Type:  next.Type,
-			Left:  node,
-			Right: p.mul(),
+	return nil
+}
+
+// commonType returns the type of the usual arithmetic conversions of two
+// integer types. An unknown type is taken to be the other one.
+func commonType(l *Ctype, r *Ctype) *Ctype {
+	if l == nil {
+		l = r
+	}
+	if r == nil {
+		r = l
+	}
+	if l == nil {
+		return nil
+	}
+	if l.Size < 4 {
+		l = ctype_int
+	}
+	if r.Size < 4 {
+		r = ctype_int
+	}
+	if l.Size != r.Size {
+		if l.Size > r.Size {
+			return l
 		}
+		return r
 	}
-	return node
+	if r.Unsigned {
+		return r
+	}
+	return l
 }
 
 func (p *Parser) unary() Node {
-	if token := p.consume('+'); token != nil {
-		return p.callExpression()
-	}
-	if token := p.consume('-'); token != nil {
-		if term := p.callExpression(); term != nil {
-			return &BinaryOperator{
-				Type: '-',
-				Left: &Integer{
-					Value: 0,
-				},
-				Right: term,
-			}
+	token := p.current()
+	switch token.Type {
+	case '+':
+		p.advance()
+		return p.unary()
+	case '-':
+		p.advance()
+		operand := p.unary()
+		if operand == nil {
+			return nil
 		}
-	}
-	if t := p.consume('&'); t != nil {
-		ident := p.consume(TK_IDENT)
-		if ident != nil {
-			exp := p.lookup(ident.Value)
-			if exp == nil {
-				panic("no variable declaration: " + ident.Value)
-			}
+		zero := &Integer{Span: token.Span, Value: 0, Ctype: ctype_int}
+		ctype := arithmeticType('-', zero, operand)
+		return &BinaryOperator{
+			Span:        p.spanFrom(token),
+			Type:        '-',
+			Left:        zero,
+			Right:       operand,
+			Ctype:       ctype,
+			OperandType: ctype,
+		}
+	case '~', '!':
+		p.advance()
+		operand := p.unary()
+		if operand == nil {
+			return nil
+		}
+		return &UnaryOperatorNode{
+			Span:       p.spanFrom(token),
+			Type:       token.Type,
+			Expression: operand,
+		}
+	case TK_INC, TK_DEC:
+		// ++e is e += 1
+		p.advance()
+		operand := p.unary()
+		if operand == nil {
+			return nil
+		}
+		if !isLvalue(operand) {
+			p.errorAt(token, "expression is not assignable")
+			return nil
+		}
+		var op int = '+'
+		if token.Type == TK_DEC {
+			op = '-'
+		}
+		one := &Integer{Span: token.Span, Value: 1, Ctype: ctype_int}
+		return &CompoundAssignment{
+			Span:        p.spanFrom(token),
+			Type:        op,
+			Left:        operand,
+			Right:       one,
+			OperandType: arithmeticType(op, operand, one),
+		}
+	case '&':
+		p.advance()
+		operand := p.unary()
+		if operand == nil {
+			return nil
+		}
+		switch operand := operand.(type) {
+		case *Identifier, *GlobalIdentifier:
 			return &UnaryOperatorNode{
+				Span:       p.spanFrom(token),
 				Type:       '&',
-				Expression: exp,
+				Expression: operand,
 			}
-		}
-	}
-	if exp := p.try(p.pointerExpression); exp != nil {
-		return exp
-	}
-	if token := p.consume(TK_SIZEOF); token != nil {
-		if t := p.consume('('); t != nil {
-			if exp := p.expression(); exp != nil {
-				if t := p.consume(')'); t != nil {
-					switch node := exp.(type) {
-					case *Identifier:
-						return &Integer{
-							Value: node.Variable.Type.Size,
-						}
-					case *Integer:
-						return &Integer{
-							Value: ctype_int.Size,
-						}
-					case *BinaryOperator:
-						return &Integer{
-							Value: node.Ctype.Size,
-						}
-					case *Char:
-						return &Integer{
-							Value: ctype_char.Size,
-						}
-					}
-				}
+		case *UnaryOperatorNode:
+			if operand.Type == '*' {
+				// &*e is the address e
+				return operand.Expression
 			}
 		}
+		p.errorAt(token, "cannot take the address of an rvalue")
+		return nil
+	case '*':
+		p.advance()
+		operand := p.unary()
+		if operand == nil {
+			return nil
+		}
+		return &UnaryOperatorNode{
+			Span:       p.spanFrom(token),
+			Type:       '*',
+			Expression: operand,
+		}
+	case TK_SIZEOF:
+		return p.sizeofExpression()
+	case TK_ALIGNOF:
+		return p.alignofExpression()
+	}
+	return p.postfix()
+}
+
+// alignofExpression parses _Alignof(type), the alignment of the type.
+func (p *Parser) alignofExpression() Node {
+	token := p.consume(TK_ALIGNOF)
+	if p.expect('(', "expected '(' after '_Alignof'") == nil {
+		return nil
+	}
+	if !p.isTypeName() {
+		p.errorAt(p.current(), "expected type")
+		return nil
+	}
+	ctype := p.typeName()
+	if ctype == nil {
+		return nil
+	}
+	if p.expect(')', "expected ')'") == nil {
+		return nil
 	}
-	if exp := p.try(p.arrayExpression); exp != nil {
-		return exp
+	return &Integer{
+		Span:  p.spanFrom(token),
+		Value: ctype.align(),
+		Ctype: ctype_ulong,
 	}
-	return p.callExpression()
 }
 
-func (p *Parser) pointerExpression() Node {
-	if tokens := p.repeat('*'); len(tokens) > 0 {
-		if exp := p.unary(); exp != nil {
-			for range tokens {
-				exp = &UnaryOperatorNode{
-					Type:       '*',
-					Expression: exp,
-				}
-			}
-			return exp
-		}
+// sizeofExpression parses sizeof applied to a unary expression, the size
+// of its type. A string literal is an array including its terminator.
+func (p *Parser) sizeofExpression() Node {
+	token := p.consume(TK_SIZEOF)
+	exp := p.unary()
+	if exp == nil {
+		return nil
+	}
+	var size int
+	if node, ok := exp.(*String); ok {
+		size = len(node.Value) + node.Ctype.Size
+	} else if ctype := expressionType(exp); ctype != nil {
+		size = ctype.Size
+	} else {
+		p.errorAt(token, "invalid application of 'sizeof'")
+		return nil
+	}
+	return &Integer{
+		Span:  p.spanFrom(token),
+		Value: size,
+		Ctype: ctype_ulong,
 	}
-	return nil
 }
 
-func (p *Parser) callExpression() Node {
-	current := p.Index
-	if t := p.consume(TK_IDENT); t != nil {
-		if token := p.consume('('); token != nil {
-			args := p.expressionList()
-			if token := p.consume(')'); token != nil {
-				return &Call{
-					Identifier: t.Value,
-					Args:       args,
-				}
+// postfix parses a primary expression followed by subscripts and postfix
+// increments and decrements. a[i] is *(a + i).
+func (p *Parser) postfix() Node {
+	node := p.term()
+	if node == nil {
+		return nil
+	}
+	for {
+		token := p.current()
+		switch token.Type {
+		case '[':
+			p.advance()
+			index := p.expression()
+			if index == nil {
+				return nil
 			}
+			if t := p.expect(']', "expected ']'"); t == nil {
+				return nil
+			}
+			span := joinSpan(node.SourceSpan(), p.previous.Span)
+			node = &UnaryOperatorNode{
+				Span: span,
+				Type: '*',
+				Expression: &BinaryOperator{
+					Span:  span,
+					Type:  '+',
+					Left:  node,
+					Right: index,
+					Ctype: additiveType('+', node, index, nil),
+				},
+			}
+		case TK_INC, TK_DEC:
+			p.advance()
+			if !isLvalue(node) {
+				p.errorAt(token, "expression is not assignable")
+				return nil
+			}
+			ty := ND_POSTINC
+			if token.Type == TK_DEC {
+				ty = ND_POSTDEC
+			}
+			node = &UnaryOperatorNode{
+				Span:       joinSpan(node.SourceSpan(), token.Span),
+				Type:       ty,
+				Expression: node,
+			}
+		default:
+			return node
 		}
 	}
-	p.Index = current
-	return p.term()
+}
+
+func (p *Parser) callExpression(ident *Token) Node {
+	p.consume('(')
+	args := p.expressionList()
+	if args == nil {
+		return nil
+	}
+	if t := p.expect(')', "expected ')'"); t == nil {
+		return nil
+	}
+	return &Call{
+		Span:       p.spanFrom(ident),
+		Identifier: ident.Value,
+		Args:       args,
+	}
 }
 
 func (p *Parser) term() Node {
-	if next := p.consume('('); next != nil {
+	token := p.current()
+	switch token.Type {
+	case '(':
+		p.advance()
 		node := p.expression()
-		if next := p.consume(')'); next != nil {
-			return node
+		if node == nil {
+			return nil
+		}
+		if t := p.expect(')', "expected ')'"); t == nil {
+			return nil
+		}
+		return node
+	case TK_NUMBER:
+		p.advance()
+		num, ctype, err := parseIntegerLiteral(token.Value)
+		if err != nil {
+			p.errorAt(token, "%s", err)
+			return nil
 		}
-	}
-	if token := p.consume(TK_NUMBER); token != nil {
-		num, _ := strconv.Atoi(token.Value)
 		return &Integer{
-			Value: num,
+			Span:  token.Span,
+			Value: int(num),
+			Ctype: ctype,
 		}
-	}
-	if token := p.consume(TK_CHAR); token != nil {
+	case TK_CHARACTER:
+		p.advance()
+		value, ctype := characterConstant(token)
 		return &Char{
-			Value: int(rune(token.Value[0])),
-		}
-	}
-	if token := p.consume(TK_STRING); token != nil {
-		runes := []rune(token.Value)
-		chars := make([]*Char, len(runes))
-		for i, r := range runes {
-			chars[i] = &Char{
-				Value: int(r),
-			}
+			Span:  token.Span,
+			Value: value,
+			Ctype: ctype,
 		}
-		p.Strings[token.Value] = len(p.Strings)
-		return &String{
-			Value: token.Value,
-			Chars: chars,
+	case TK_STRING:
+		return p.stringLiteral()
+	case TK_IDENT:
+		p.advance()
+		if p.current().Type == '(' {
+			return p.callExpression(token)
 		}
-	}
-	if ident := p.consume(TK_IDENT); ident != nil {
-		if i := p.lookup(ident.Value); i != nil {
+		if i := p.lookup(token); i != nil {
 			return i
 		}
+		p.errorAt(token, "use of undeclared identifier '%s'", token.Value)
+		return nil
+	case TK_EMBED:
+		p.errorAt(token, "#embed is only supported in array initializers")
+		return nil
 	}
+	p.errorAt(token, "expected expression")
 	return nil
 }
 
-func (p *Parser) try(f func() Node) Node {
-	current := p.Index
-	ret := f()
-	if ret == nil {
-		p.Index = current
-		return nil
-	}
-	return ret
+// charConstantTypes maps encoding prefixes to the type of character constants.
+var charConstantTypes = map[int]*Ctype{
+	ENC_NONE:  ctype_int,
+	ENC_UTF8:  ctype_uchar,
+	ENC_UTF16: ctype_ushort,
+	ENC_UTF32: ctype_uint,
+	ENC_WCHAR: ctype_int,
 }
 
-func (p *Parser) expressionList() []Node {
-	expressionList := []Node{}
+// stringElementTypes maps encoding prefixes to the element type of string
+// literals: char, char16_t, char32_t and wchar_t.
+var stringElementTypes = map[int]*Ctype{
+	ENC_NONE:  ctype_char,
+	ENC_UTF8:  ctype_char,
+	ENC_UTF16: ctype_ushort,
+	ENC_UTF32: ctype_uint,
+	ENC_WCHAR: ctype_int,
+}
+
+// stringLiteral parses a sequence of adjacent string literals into a single
+// String. If any piece has an encoding prefix the whole literal takes it.
+func (p *Parser) stringLiteral() Node {
+	first := p.consume(TK_STRING)
+	if first == nil {
+		return nil
+	}
+	tokens := []*Token{first}
+	encoding := first.Encoding
 	for {
-		exp := p.expression()
-		if exp == nil {
+		token := p.consume(TK_STRING)
+		if token == nil {
 			break
 		}
-		expressionList = append(expressionList, exp)
-		if token := p.consume(','); token == nil {
-			break
+		if token.Encoding != ENC_NONE {
+			if encoding != ENC_NONE && encoding != token.Encoding {
+				p.errorAt(token, "unsupported concatenation of differently prefixed string literals")
+			}
+			encoding = token.Encoding
 		}
+		tokens = append(tokens, token)
 	}
-	return expressionList
-}
 
-func (p *Parser) getCtype(l Node, r Node) *Ctype {
-	if l != nil {
-		if ident, ok := l.(*Identifier); ok {
-			return ident.Variable.Type
+	size := encodingSize(encoding)
+	value := []byte{}
+	for _, token := range tokens {
+		if encodingSize(token.Encoding) == size {
+			value = append(value, token.Value...)
+			continue
 		}
-	}
-	if r != nil {
-		if ident, ok := r.(*Identifier); ok {
-			return ident.Variable.Type
+		// A narrow piece of a wide literal is re-encoded character by
+		// character; bytes that are not valid UTF-8 keep their value.
+		for i := 0; i < len(token.Value); {
+			r, n := utf8.DecodeRuneInString(token.Value[i:])
+			if r == utf8.RuneError && n == 1 {
+				value = appendCodeUnit(value, uint32(token.Value[i]), size)
+			} else {
+				value = appendCharacter(value, r, size)
+			}
+			i += n
 		}
 	}
-	if l != nil {
-		switch node := l.(type) {
-		case *BinaryOperator:
-			return node.Ctype
-		case *Integer:
-			return ctype_int
+
+	ctype := stringElementTypes[encoding]
+	units := codeUnits(string(value), size)
+	chars := make([]*Char, len(units))
+	for i, unit := range units {
+		chars[i] = &Char{
+			Span:  first.Span,
+			Value: codeUnitValue(unit, ctype),
+			Ctype: ctype,
 		}
 	}
-	if r != nil {
-		switch node := l.(type) {
-		case *BinaryOperator:
-			return node.Ctype
-		case *Integer:
-			return ctype_int
+	node := &String{
+		Span:  p.spanFrom(first),
+		Value: string(value),
+		Chars: chars,
+		Ctype: ctype,
+		Index: len(p.Strings),
+	}
+	p.Strings = append(p.Strings, node)
+	return node
+}
+
+// codeUnitValue converts a code unit to the value it has as ctype.
+func codeUnitValue(unit uint32, ctype *Ctype) int {
+	if ctype.Unsigned {
+		return int(unit)
+	}
+	switch ctype.Size {
+	case 1:
+		return int(int8(unit))
+	case 2:
+		return int(int16(unit))
+	}
+	return int(int32(unit))
+}
+
+// characterConstant returns the value and type of a TK_CHARACTER token.
+func characterConstant(token *Token) (int, *Ctype) {
+	ctype := charConstantTypes[token.Encoding]
+	value := 0
+	if token.Encoding == ENC_NONE {
+		value = charConstantValue(token.Value)
+	} else if units := codeUnits(token.Value, encodingSize(token.Encoding)); len(units) > 0 {
+		// Like gcc, a wide constant with several characters takes the last.
+		value = codeUnitValue(units[len(units)-1], ctype)
+	}
+	return value, ctype
+}
+
+// charConstantValue returns the int value of a character constant. A single
+// byte is sign-extended as a char; multi-character constants pack their bytes
+// big-endian into an int like gcc.
+func charConstantValue(s string) int {
+	if len(s) == 1 {
+		return int(int8(s[0]))
+	}
+	var v int32
+	for i := 0; i < len(s); i++ {
+		v = v<<8 | int32(s[i])
+	}
+	return int(v)
+}
+
+// spanFrom returns the range from start to the last consumed token.
+func (p *Parser) spanFrom(start *Token) Span {
+	return joinSpan(start.Span, p.previous.Span)
+}
+
+// expressionList parses the arguments of a call up to its ')', returning
+// nil after an error.
+func (p *Parser) expressionList() []Node {
+	expressionList := []Node{}
+	if p.current().Type == ')' {
+		return expressionList
+	}
+	for {
+		exp := p.assign()
+		if exp == nil {
+			return nil
+		}
+		expressionList = append(expressionList, exp)
+		if token := p.consume(','); token == nil {
+			return expressionList
 		}
 	}
-	return nil
 }
 
 func (p *Parser) localVariableStackSize() int {
 	stackSize := 0
 	for _, v := range p.LVars {
-		var size int
-		if v.Type.Size%8 == 0 {
-			size = v.Type.Size
-		} else {
-			size = v.Type.Size - v.Type.Size%8 + 8
-		}
-		stackSize += size
+		stackSize += slotSize(v.Type) + v.Padding
 	}
 	return stackSize
 }
 
-func (p *Parser) lookup(ident string) Node {
-	if v, ok := p.LVars[ident]; ok {
+// slotSize returns the stack space of a local, its size rounded up to a
+// multiple of 8.
+func slotSize(ctype *Ctype) int {
+	return (ctype.Size + 7) / 8 * 8
+}
+
+func (p *Parser) lookup(ident *Token) Node {
+	if v, ok := p.LVars[ident.Value]; ok {
 		return &Identifier{
-			Value:    ident,
+			Span:     ident.Span,
+			Value:    ident.Value,
 			Variable: v,
 		}
-	} else if v, ok := p.GVars[ident]; ok {
+	} else if v, ok := p.GVars[ident.Value]; ok {
 		return &GlobalIdentifier{
-			Value:    ident,
+			Span:     ident.Span,
+			Value:    ident.Value,
 			Variable: v,
 		}
 	}
 	return nil
 }
 
-func (p *Parser) createLocalVariable(ctype *Ctype) *Variable {
+// STACK_ALIGN is the alignment of the frame pointer, which a call leaves at
+// 16 bytes as the System V ABI requires.
+const STACK_ALIGN = 16
+
+// createLocalVariable places a local below the ones created before it,
+// with padding below it to align it to align, at most STACK_ALIGN.
+func (p *Parser) createLocalVariable(ctype *Ctype, align int) *Variable {
+	used := p.localVariableStackSize()
+	bottom := used + slotSize(ctype)
+	padding := 0
+	if align > 0 && bottom%align != 0 {
+		padding = align - bottom%align
+	}
 	return &Variable{
-		Type:  ctype,
-		Index: p.localVariableStackSize() / 8,
+		Type:    ctype,
+		Index:   (bottom+padding)/8 - 1,
+		Padding: padding,
 	}
 }
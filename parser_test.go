@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// operatorNames spells the node types that are not a single character.
+var operatorNames = map[int]string{
+	ND_EQUAL:    "==",
+	ND_NOTEQUAL: "!=",
+	ND_LE:       "<=",
+	ND_GE:       ">=",
+	ND_LSHIFT:   "<<",
+	ND_RSHIFT:   ">>",
+	ND_LOGAND:   "&&",
+	ND_LOGOR:    "||",
+	ND_POSTINC:  "post++",
+	ND_POSTDEC:  "post--",
+}
+
+func operatorName(op int) string {
+	if name, ok := operatorNames[op]; ok {
+		return name
+	}
+	return string(rune(op))
+}
+
+// shape prints an expression tree as an s-expression.
+func shape(n Node) string {
+	switch n := n.(type) {
+	case *Integer:
+		return fmt.Sprint(n.Value)
+	case *Identifier:
+		return n.Value
+	case *BinaryOperator:
+		return fmt.Sprintf("(%s %s %s)", operatorName(n.Type), shape(n.Left), shape(n.Right))
+	case *CompoundAssignment:
+		return fmt.Sprintf("(%s= %s %s)", operatorName(n.Type), shape(n.Left), shape(n.Right))
+	case *UnaryOperatorNode:
+		return fmt.Sprintf("(%s %s)", operatorName(n.Type), shape(n.Expression))
+	case *Conditional:
+		return fmt.Sprintf("(? %s %s %s)", shape(n.Condition), shape(n.Then), shape(n.Else))
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+// parseExpression parses src as the expression of a return statement in a
+// function with the int variables a, b and c.
+func parseExpression(t *testing.T, src string) Node {
+	t.Helper()
+	source := fmt.Sprintf("int main() { int a; int b; int c; return %s; }", src)
+	p := NewParser(NewLexer("test.c", source))
+	declarations := p.Parse()
+	for _, d := range p.Diagnostics {
+		t.Fatalf("%s: %s", src, d.Error())
+	}
+	statements := declarations[0].(*Function).Statements
+	return statements[len(statements)-1].(*Return).Expression
+}
+
+func TestExpressionShape(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// comma
+		{"a = 1, b = 2, c", "(, (, (= a 1) (= b 2)) c)"},
+		// assignment, right associative
+		{"a = b = c", "(= a (= b c))"},
+		{"a += b -= 1", "(+= a (-= b 1))"},
+		{"a <<= b || c", "(<<= a (|| b c))"},
+		// conditional, right associative
+		{"a ? b : c ? 1 : 2", "(? a b (? c 1 2))"},
+		{"a || b ? c : 1", "(? (|| a b) c 1)"},
+		{"a ? b = 1 : 2", "(? a (= b 1) 2)"},
+		// logical or and and
+		{"a || b && c", "(|| a (&& b c))"},
+		{"a && b || c", "(|| (&& a b) c)"},
+		{"a || b || c", "(|| (|| a b) c)"},
+		// bitwise or, xor and and
+		{"a && b | c", "(&& a (| b c))"},
+		{"a | b ^ c", "(| a (^ b c))"},
+		{"a ^ b & c", "(^ a (& b c))"},
+		{"a & b ^ c | 1", "(| (^ (& a b) c) 1)"},
+		// equality and relational
+		{"a & b == c", "(& a (== b c))"},
+		{"a == b < c", "(== a (< b c))"},
+		{"a != b >= c", "(!= a (>= b c))"},
+		{"a < b > c", "(> (< a b) c)"},
+		{"a <= b << c", "(<= a (<< b c))"},
+		// shifts
+		{"a << b + c", "(<< a (+ b c))"},
+		{"a >> b >> c", "(>> (>> a b) c)"},
+		// additive and multiplicative
+		{"a - b - c", "(- (- a b) c)"},
+		{"a + b * c", "(+ a (* b c))"},
+		{"a * b / c % 2", "(% (/ (* a b) c) 2)"},
+		// unary and postfix
+		{"-a * b", "(* (- 0 a) b)"},
+		{"~a + !b", "(+ (~ a) (! b))"},
+		{"++a * 2", "(* (+= a 1) 2)"},
+		{"a++ + --b", "(+ (post++ a) (-= b 1))"},
+		{"-a++", "(- 0 (post++ a))"},
+		{"*&a", "(* (& a))"},
+		{"&*a", "a"},
+		// parentheses
+		{"(a + b) * c", "(* (+ a b) c)"},
+		{"a * (b, c)", "(* a (, b c))"},
+	}
+	for _, test := range tests {
+		got := shape(parseExpression(t, test.src))
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"1 = a", "expression is not assignable"},
+		{"a +", "expected expression"},
+		{"a ? b", "expected ':'"},
+	}
+	for _, test := range tests {
+		source := fmt.Sprintf("int main() { int a; int b; return %s; }", test.src)
+		p := NewParser(NewLexer("test.c", source))
+		p.Parse()
+		if len(p.Diagnostics) == 0 || !strings.Contains(p.Diagnostics[0].Message, test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.src, p.Diagnostics, test.want)
+		}
+	}
+}
+
+func TestExpressionType(t *testing.T) {
+	tests := []struct {
+		src  string
+		want *Ctype
+	}{
+		{"a * u", ctype_uint},
+		{"a / l", ctype_long},
+		{"u % l", ctype_long},
+		{"c & c", ctype_int},
+		{"u << l", ctype_uint},
+		{"a >> u", ctype_int},
+		{"-u", ctype_uint},
+		{"~c", ctype_int},
+		{"a ? u : l", ctype_long},
+		{"u < a", ctype_int},
+		{"p + a", &Ctype{Value: TYPE_PTR, Ptrof: ctype_int, Size: 8}},
+		{"p - p", ctype_long},
+		{"1 + p + 1", &Ctype{Value: TYPE_PTR, Ptrof: ctype_int, Size: 8}},
+		{"&a + 1", &Ctype{Value: TYPE_PTR, Ptrof: ctype_int, Size: 8}},
+		{"*(a ? p : p + 1)", ctype_int},
+	}
+	for _, test := range tests {
+		source := fmt.Sprintf("int main() { int a; unsigned u; long l; char c; int *p; return %s; }", test.src)
+		p := NewParser(NewLexer("test.c", source))
+		declarations := p.Parse()
+		if len(p.Diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.src, p.Diagnostics[0].Error())
+		}
+		statements := declarations[0].(*Function).Statements
+		got := expressionType(statements[len(statements)-1].(*Return).Expression)
+		if !sameType(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.src, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// ppValue is a value of a #if expression. Every integer has the type
+// intmax_t or uintmax_t there.
+type ppValue struct {
+	Value    int64
+	Unsigned bool
+}
+
+func (v ppValue) isTrue() bool {
+	return v.Value != 0
+}
+
+func ppBool(b bool) ppValue {
+	if b {
+		return ppValue{Value: 1}
+	}
+	return ppValue{}
+}
+
+// ppExpr evaluates the fully macro-expanded tokens of a #if or #elif line.
+// Only the first error is reported; the expression is then false.
+type ppExpr struct {
+	pp        *Preprocessor
+	directive *Token
+	tokens    []*Token
+	pos       int
+	failed    bool
+	// unevaluated counts the enclosing operands that are not evaluated,
+	// like the right of a false &&, where division by zero is allowed.
+	unevaluated int
+}
+
+func (pp *Preprocessor) evaluate(directive *Token, tokens []*Token) bool {
+	value, ok := pp.constantExpression(directive, tokens)
+	return ok && value.isTrue()
+}
+
+// constantExpression evaluates tokens as an integer constant expression of
+// directive, such as the limit of #embed. It reports false on an error.
+func (pp *Preprocessor) constantExpression(directive *Token, tokens []*Token) (ppValue, bool) {
+	if len(tokens) == 0 {
+		pp.errorAt(directive.Span, "#%s with no expression", directive.Value)
+		return ppValue{}, false
+	}
+	e := &ppExpr{pp: pp, directive: directive, tokens: tokens}
+	value := e.comma()
+	if !e.failed && e.pos < len(tokens) {
+		t := tokens[e.pos]
+		if t.Type == ')' {
+			e.errorAt(t, "missing '(' in expression")
+		} else {
+			e.errorAt(t, "missing binary operator before token \"%s\"", t.Spelling)
+		}
+	}
+	return value, !e.failed
+}
+
+func (e *ppExpr) errorAt(t *Token, format string, args ...interface{}) {
+	if !e.failed {
+		e.pp.errorAtToken(t, format, args...)
+	}
+	e.failed = true
+}
+
+func (e *ppExpr) peek() *Token {
+	if e.failed || e.pos >= len(e.tokens) {
+		return nil
+	}
+	return e.tokens[e.pos]
+}
+
+func (e *ppExpr) consume(ty int) *Token {
+	if t := e.peek(); t != nil && t.Type == ty {
+		e.pos++
+		return t
+	}
+	return nil
+}
+
+func (e *ppExpr) comma() ppValue {
+	value := e.conditional()
+	for e.consume(',') != nil {
+		value = e.conditional()
+	}
+	return value
+}
+
+func (e *ppExpr) conditional() ppValue {
+	cond := e.binary(1)
+	question := e.consume('?')
+	if question == nil {
+		return cond
+	}
+	if !cond.isTrue() {
+		e.unevaluated++
+	}
+	then := e.comma()
+	if !cond.isTrue() {
+		e.unevaluated--
+	}
+	if e.consume(':') == nil {
+		e.errorAt(question, "'?' without following ':'")
+		return ppValue{}
+	}
+	if cond.isTrue() {
+		e.unevaluated++
+	}
+	otherwise := e.conditional()
+	if cond.isTrue() {
+		e.unevaluated--
+	}
+	result := otherwise
+	if cond.isTrue() {
+		result = then
+	}
+	result.Unsigned = then.Unsigned || otherwise.Unsigned
+	return result
+}
+
+// binary parses operators of precedence minPrecedence or higher by
+// precedence climbing.
+func (e *ppExpr) binary(minPrecedence int) ppValue {
+	lhs := e.unary()
+	for {
+		op := e.peek()
+		if op == nil {
+			return lhs
+		}
+		precedence, ok := binaryPrecedence[op.Type]
+		if !ok || precedence < minPrecedence {
+			return lhs
+		}
+		e.pos++
+		// the right operand of a short-circuit operator may be unevaluated
+		shortCircuit := (op.Type == TK_LOGAND && !lhs.isTrue()) || (op.Type == TK_LOGOR && lhs.isTrue())
+		if shortCircuit {
+			e.unevaluated++
+		}
+		rhs := e.binary(precedence + 1)
+		if shortCircuit {
+			e.unevaluated--
+		}
+		lhs = e.apply(op, lhs, rhs)
+	}
+}
+
+func (e *ppExpr) apply(op *Token, lhs ppValue, rhs ppValue) ppValue {
+	switch op.Type {
+	case TK_LOGAND:
+		return ppBool(lhs.isTrue() && rhs.isTrue())
+	case TK_LOGOR:
+		return ppBool(lhs.isTrue() || rhs.isTrue())
+	case TK_LSHIFT, TK_RSHIFT:
+		// the result has the type of the left operand
+		n := uint64(rhs.Value)
+		if !rhs.Unsigned && rhs.Value < 0 {
+			n = uint64(-rhs.Value)
+			if op.Type == TK_LSHIFT {
+				op = &Token{Type: TK_RSHIFT}
+			} else {
+				op = &Token{Type: TK_LSHIFT}
+			}
+		}
+		if n > 63 {
+			if op.Type == TK_RSHIFT && !lhs.Unsigned && lhs.Value < 0 {
+				return ppValue{Value: -1}
+			}
+			return ppValue{Unsigned: lhs.Unsigned}
+		}
+		if op.Type == TK_LSHIFT {
+			return ppValue{Value: lhs.Value << n, Unsigned: lhs.Unsigned}
+		}
+		if lhs.Unsigned {
+			return ppValue{Value: int64(uint64(lhs.Value) >> n), Unsigned: true}
+		}
+		return ppValue{Value: lhs.Value >> n}
+	}
+
+	// the usual arithmetic conversions
+	unsigned := lhs.Unsigned || rhs.Unsigned
+	l, r := lhs.Value, rhs.Value
+	switch op.Type {
+	case TK_EQUAL:
+		return ppBool(l == r)
+	case TK_NOTEQUAL:
+		return ppBool(l != r)
+	case '<', '>', TK_LE, TK_GE:
+		less := l < r
+		if unsigned {
+			less = uint64(l) < uint64(r)
+		}
+		switch op.Type {
+		case '<':
+			return ppBool(less)
+		case '>':
+			return ppBool(!less && l != r)
+		case TK_LE:
+			return ppBool(less || l == r)
+		}
+		return ppBool(!less)
+	case '/', '%':
+		if r == 0 {
+			if e.unevaluated == 0 {
+				e.errorAt(op, "division by zero in #%s", e.directive.Value)
+			}
+			return ppValue{Unsigned: unsigned}
+		}
+		if unsigned {
+			if op.Type == '/' {
+				return ppValue{Value: int64(uint64(l) / uint64(r)), Unsigned: true}
+			}
+			return ppValue{Value: int64(uint64(l) % uint64(r)), Unsigned: true}
+		}
+		if r == -1 {
+			// avoids the overflow trap of INTMAX_MIN / -1
+			if op.Type == '/' {
+				return ppValue{Value: -l}
+			}
+			return ppValue{}
+		}
+		if op.Type == '/' {
+			return ppValue{Value: l / r}
+		}
+		return ppValue{Value: l % r}
+	}
+
+	var v int64
+	switch op.Type {
+	case '|':
+		v = l | r
+	case '^':
+		v = l ^ r
+	case '&':
+		v = l & r
+	case '+':
+		v = l + r
+	case '-':
+		v = l - r
+	case '*':
+		v = l * r
+	}
+	return ppValue{Value: v, Unsigned: unsigned}
+}
+
+func (e *ppExpr) unary() ppValue {
+	t := e.peek()
+	if t == nil {
+		if e.pos > 0 && !e.failed {
+			operator := e.tokens[e.pos-1]
+			e.errorAt(operator, "operator '%s' has no right operand", operator.Spelling)
+		}
+		return ppValue{}
+	}
+	switch t.Type {
+	case '+':
+		e.pos++
+		return e.unary()
+	case '-':
+		e.pos++
+		v := e.unary()
+		return ppValue{Value: -v.Value, Unsigned: v.Unsigned}
+	case '~':
+		e.pos++
+		v := e.unary()
+		return ppValue{Value: ^v.Value, Unsigned: v.Unsigned}
+	case '!':
+		e.pos++
+		return ppBool(!e.unary().isTrue())
+	}
+	return e.primary()
+}
+
+func (e *ppExpr) primary() ppValue {
+	t := e.peek()
+	e.pos++
+	switch t.Type {
+	case '(':
+		v := e.comma()
+		if !e.failed && e.consume(')') == nil {
+			e.errorAt(t, "missing ')' in expression")
+		}
+		return v
+	case TK_NUMBER:
+		n, _, err := parseIntegerLiteral(t.Value)
+		if err != nil {
+			e.errorAt(t, "%s in #%s", err, e.directive.Value)
+			return ppValue{}
+		}
+		// unsigned only with a u suffix or when intmax_t cannot hold it
+		return ppValue{Value: int64(n), Unsigned: strings.ContainsAny(t.Value, "uU") || n > math.MaxInt64}
+	case TK_CHARACTER:
+		value, ctype := characterConstant(t)
+		return ppValue{Value: int64(value), Unsigned: ctype.Unsigned}
+	}
+	if isIdentifierToken(t) {
+		// identifiers left after macro expansion are 0
+		return ppValue{}
+	}
+	e.errorAt(t, "token \"%s\" is not valid in preprocessor expressions", t.Spelling)
+	return ppValue{}
+}
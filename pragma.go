@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PragmaHandler handles the #pragma directives registered for a name, the
+// first token after #pragma. It is given that token and the rest of the
+// line, and returns the tokens to put in place of the directive. An error
+// is reported at the directive.
+type PragmaHandler interface {
+	HandlePragma(pp *Preprocessor, name *Token, args []*Token) ([]*Token, error)
+}
+
+// PragmaHandlerFunc adapts a function to a PragmaHandler.
+type PragmaHandlerFunc func(pp *Preprocessor, name *Token, args []*Token) ([]*Token, error)
+
+func (f PragmaHandlerFunc) HandlePragma(pp *Preprocessor, name *Token, args []*Token) ([]*Token, error) {
+	return f(pp, name, args)
+}
+
+// RegisterPragma sets the handler of "#pragma name". Pragmas without a
+// handler are passed on as TK_PRAGMA tokens.
+func (pp *Preprocessor) RegisterPragma(name string, handler PragmaHandler) {
+	pp.pragmas[name] = handler
+}
+
+func (pp *Preprocessor) registerBuiltinPragmas() {
+	pp.RegisterPragma("once", PragmaHandlerFunc(pragmaOnce))
+	pp.RegisterPragma("pack", PragmaHandlerFunc(pragmaPack))
+}
+
+func (pp *Preprocessor) pragma(file *sourceFile, directive *Token) {
+	line := pp.readLine(file)
+	if len(line) == 0 {
+		return
+	}
+	name, args := line[0], line[1:]
+	handler, ok := pp.pragmas[name.Value]
+	if !ok {
+		pp.unreadTokens([]*Token{pragmaToken(name, args)})
+		return
+	}
+	tokens, err := handler.HandlePragma(pp, name, args)
+	if err != nil {
+		pp.errorAt(name.Span, "%s", err)
+	}
+	pp.unreadTokens(tokens)
+}
+
+// pragmaToken returns a TK_PRAGMA token for a pragma that is left to the
+// compiler. It is spelled as the directive so that -E prints it.
+func pragmaToken(name *Token, args []*Token) *Token {
+	return &Token{
+		Span:     name.Span,
+		Type:     TK_PRAGMA,
+		Value:    name.Value,
+		Spelling: "#pragma" + lineText(append([]*Token{name}, args...)),
+		AtBOL:    true,
+	}
+}
+
+func pragmaOnce(pp *Preprocessor, name *Token, args []*Token) ([]*Token, error) {
+	if len(args) > 0 {
+		pp.warningAt(args[0].Span, "extra tokens at end of #pragma once directive")
+	}
+	file := pp.files[len(pp.files)-1]
+	if len(pp.files) == 1 {
+		pp.warningAt(name.Span, "#pragma once in main file")
+	}
+	pp.onceFiles[file.Path] = true
+	return nil, nil
+}
+
+// packEntry is an entry of the #pragma pack stack.
+type packEntry struct {
+	Alignment int
+	Name      string
+}
+
+// pragmaPack handles the forms of #pragma pack accepted by gcc: pack(n),
+// pack(), pack(push[, name][, n]), pack(pop[, name | n]) and pack(show).
+// Like gcc, a malformed pragma is ignored with a warning. mycc has no
+// structs to lay out, so the alignment only shows in pack(show), and the
+// pragma is passed on as a TK_PRAGMA token for -E output.
+func pragmaPack(pp *Preprocessor, name *Token, args []*Token) ([]*Token, error) {
+	if len(args) < 2 || args[0].Type != '(' || args[len(args)-1].Type != ')' {
+		pp.warningAt(name.Span, "missing '(' after '#pragma pack' - ignored")
+		return nil, nil
+	}
+	operands := [][]*Token{}
+	if inner := args[1 : len(args)-1]; len(inner) > 0 {
+		operand := []*Token{}
+		for _, t := range inner {
+			if t.Type == ',' {
+				operands = append(operands, operand)
+				operand = []*Token{}
+				continue
+			}
+			operand = append(operand, t)
+		}
+		operands = append(operands, operand)
+	}
+	for _, operand := range operands {
+		if len(operand) != 1 {
+			pp.warningAt(name.Span, "malformed '#pragma pack' - ignored")
+			return nil, nil
+		}
+	}
+
+	action := ""
+	if len(operands) > 0 && isIdentifierToken(operands[0][0]) {
+		action = operands[0][0].Value
+		operands = operands[1:]
+	}
+	alignment, label, hasAlignment := 0, "", false
+	for _, operand := range operands {
+		t := operand[0]
+		switch {
+		case t.Type == TK_NUMBER && !hasAlignment:
+			n, err := strconv.Atoi(t.Value)
+			if err != nil || n < 0 || n > 16 || n&(n-1) != 0 {
+				pp.warningAt(t.Span, "alignment must be a small power of two, not %s", t.Spelling)
+				return nil, nil
+			}
+			alignment, hasAlignment = n, true
+		case isIdentifierToken(t) && label == "" && !hasAlignment && action != "":
+			label = t.Value
+		default:
+			pp.warningAt(t.Span, "malformed '#pragma pack' - ignored")
+			return nil, nil
+		}
+	}
+
+	switch action {
+	case "":
+		pp.pack = alignment
+	case "push":
+		pp.packStack = append(pp.packStack, packEntry{Alignment: pp.pack, Name: label})
+		if hasAlignment {
+			pp.pack = alignment
+		}
+	case "pop":
+		if hasAlignment && label != "" {
+			pp.warningAt(name.Span, "malformed '#pragma pack' - ignored")
+			return nil, nil
+		}
+		i := len(pp.packStack) - 1
+		if label != "" {
+			for i >= 0 && pp.packStack[i].Name != label {
+				i--
+			}
+		}
+		if i < 0 {
+			pp.warningAt(name.Span, "#pragma pack (pop) encountered without matching #pragma pack (push)")
+			return nil, nil
+		}
+		pp.pack = pp.packStack[i].Alignment
+		pp.packStack = pp.packStack[:i]
+		if hasAlignment {
+			pp.pack = alignment
+		}
+	case "show":
+		if len(operands) > 0 {
+			pp.warningAt(name.Span, "malformed '#pragma pack' - ignored")
+			return nil, nil
+		}
+		pp.warningAt(name.Span, "value of #pragma pack(show) == %s", packString(pp.pack))
+		return nil, nil
+	default:
+		pp.warningAt(name.Span, "unknown action '%s' for '#pragma pack' - ignored", action)
+		return nil, nil
+	}
+	return []*Token{pragmaToken(name, args)}, nil
+}
+
+func packString(alignment int) string {
+	if alignment == 0 {
+		return "default"
+	}
+	return fmt.Sprint(alignment)
+}
+
+// skipsInclude reports whether including the file at path again has no
+// effect because of #pragma once or an include guard that is defined.
+func (pp *Preprocessor) skipsInclude(path string) bool {
+	if pp.onceFiles[path] {
+		return true
+	}
+	guard, ok := pp.includeGuards[path]
+	return ok && pp.isDefined(guard)
+}
+
+// The states of include guard detection. A file is guarded when nothing
+// but comments is outside "#ifndef NAME ... #endif".
+const (
+	GUARD_START = iota
+	GUARD_INSIDE
+	GUARD_END
+	GUARD_NONE
+)
+
+// noteContent records a token or directive found outside of any include
+// guard of file.
+func (file *sourceFile) noteContent() {
+	if file.guardState != GUARD_INSIDE {
+		file.guardState = GUARD_NONE
+	}
+}
+
+// noteElse records an #elif or #else, which ends the detection if it
+// belongs to the include guard.
+func (file *sourceFile) noteElse() {
+	if file.guardState == GUARD_INSIDE && len(file.conditionals)-1 == file.guardDepth {
+		file.guardState = GUARD_NONE
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// predefinedMacros are defined before any source is read, as if by -D.
+var predefinedMacros = []string{
+	"__STDC__=1",
+	"__STDC_VERSION__=201112L",
+	"__STDC_HOSTED__=1",
+	"__x86_64__=1",
+	"__x86_64=1",
+	"__linux__=1",
+	"__linux=1",
+	"__unix__=1",
+	"__LP64__=1",
+	"_LP64=1",
+	"__CHAR_BIT__=8",
+	"__SIZEOF_INT__=4",
+	"__SIZEOF_LONG__=8",
+	"__SIZEOF_POINTER__=8",
+}
+
+// dynamicMacros are object-like macros whose replacement is computed at
+// each use.
+var dynamicMacros = map[string]func(pp *Preprocessor, token *Token) []*Token{
+	"__FILE__": func(pp *Preprocessor, token *Token) []*Token {
+		return pp.lexText(quoteString(token.Location().File), token)
+	},
+	"__LINE__": func(pp *Preprocessor, token *Token) []*Token {
+		return pp.lexText(strconv.Itoa(token.Location().Line), token)
+	},
+	"__COUNTER__": func(pp *Preprocessor, token *Token) []*Token {
+		pp.counter++
+		return pp.lexText(strconv.Itoa(pp.counter-1), token)
+	},
+	"__DATE__": func(pp *Preprocessor, token *Token) []*Token {
+		return pp.lexText(quoteString(pp.Time.Format("Jan _2 2006")), token)
+	},
+	"__TIME__": func(pp *Preprocessor, token *Token) []*Token {
+		return pp.lexText(quoteString(pp.Time.Format("15:04:05")), token)
+	},
+}
+
+// MaxSourceDateEpoch is the largest SOURCE_DATE_EPOCH accepted, the end of
+// year 9999.
+const MaxSourceDateEpoch = 253402300799
+
+// SourceDateEpoch parses the value of the SOURCE_DATE_EPOCH environment
+// variable, which fixes __DATE__ and __TIME__ for reproducible builds.
+func SourceDateEpoch(value string) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 || seconds > MaxSourceDateEpoch {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+func (pp *Preprocessor) definePredefinedMacros() {
+	for _, definition := range predefinedMacros {
+		pp.defineText("<built-in>", definition)
+	}
+	for name, handler := range dynamicMacros {
+		pp.Macros[name] = &Macro{
+			Span:    Span{File: "<built-in>"},
+			Name:    name,
+			Handler: handler,
+		}
+	}
+}
+
+// Define defines a macro from a command line definition "NAME", "NAME=VALUE"
+// or "NAME(PARAMS)=VALUE". NAME alone is defined as 1.
+func (pp *Preprocessor) Define(definition string) {
+	pp.defineText("<command-line>", definition)
+}
+
+// Undefine removes a macro as -U does.
+func (pp *Preprocessor) Undefine(name string) {
+	delete(pp.Macros, name)
+}
+
+func (pp *Preprocessor) defineText(file string, definition string) {
+	text := definition + " 1"
+	if i := strings.IndexByte(definition, '='); i >= 0 {
+		text = definition[:i] + " " + definition[i+1:]
+	}
+	source := &sourceFile{Name: file, lexer: NewLexer(file, "#define "+text)}
+	source.next()
+	pp.define(source, source.next())
+	if rest := pp.readLine(source); len(rest) > 0 {
+		pp.warningAt(rest[0].Span, "extra tokens at end of #define directive")
+	}
+	pp.Diagnostics = append(pp.Diagnostics, source.lexer.Diagnostics...)
+}
+
+// lexText lexes the replacement of a dynamic macro used at token.
+func (pp *Preprocessor) lexText(text string, token *Token) []*Token {
+	tokens, diagnostics := NewLexer(token.File, text).Tokenize()
+	pp.Diagnostics = append(pp.Diagnostics, diagnostics...)
+	tokens = tokens[:len(tokens)-1]
+	for _, t := range tokens {
+		t.Span = token.Span
+	}
+	return tokens
+}
+
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
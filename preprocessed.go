@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	MARKER_NONE = iota
+	MARKER_ENTER
+	MARKER_RETURN
+)
+
+// lineMarker records that the tokens from Index on come from File, starting
+// at Line. The preprocessor adds one whenever it enters or returns from an
+// included file and for every #line.
+type lineMarker struct {
+	Index int
+	File  string
+	Line  int
+	Flag  int
+}
+
+// maxBlankLines is the number of blank lines printed to keep the output in
+// step with the source before a linemarker is printed instead.
+const maxBlankLines = 8
+
+// WritePreprocessed reads the tokens of the started file and prints them as
+// a preprocessed translation unit. Like gcc -E, linemarkers
+// "# line "file" flags" record where each line came from: flag 1 enters an
+// included file, 2 returns to the includer and 3 marks a system header.
+func (pp *Preprocessor) WritePreprocessed(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# 1 %s\n", quoteString(pp.mainFile))
+	file, line := pp.mainFile, 1
+	for i := 0; ; i++ {
+		t := pp.Next()
+		// the markers of the files entered or left before t are recorded by
+		// now; they are dropped once printed
+		for ; len(pp.markers) > 0 && pp.markers[0].Index <= i; pp.markers = pp.markers[1:] {
+			m := pp.markers[0]
+			flags := ""
+			if m.Flag != MARKER_NONE {
+				flags = fmt.Sprintf(" %d", m.Flag)
+			}
+			if pp.isSystemHeader(m.File) {
+				flags += " 3"
+			}
+			fmt.Fprintf(out, "\n# %d %s%s", m.Line, quoteString(m.File), flags)
+			file, line = m.File, m.Line-1
+		}
+		if t.Type == TK_EOF {
+			break
+		}
+		// tokens of macro expansions are printed where the macro is used
+		at := t.Location()
+		if t.AtBOL || at.File != file || line < 1 {
+			if at.File != file || at.Line < line || at.Line > line+maxBlankLines {
+				fmt.Fprintf(out, "\n# %d %s\n", at.Line, quoteString(at.File))
+			} else {
+				out.WriteString(strings.Repeat("\n", at.Line-line))
+			}
+			file, line = at.File, at.Line
+			if at.Column > 1 && t.Type != TK_PRAGMA {
+				// keep the indentation, approximately
+				out.WriteString(strings.Repeat(" ", at.Column-1))
+			}
+		} else if t.HasSpace {
+			out.WriteString(" ")
+		}
+		if t.Type == TK_EMBED {
+			writeEmbed(out, t.Resource.Data)
+			continue
+		}
+		out.WriteString(t.Spelling)
+	}
+	out.WriteString("\n")
+	return out.Flush()
+}
+
+// writeEmbed prints the bytes of a #embed resource as the list of integer
+// constants they stand for.
+func writeEmbed(out *bufio.Writer, data []byte) {
+	for i, b := range data {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		out.WriteString(strconv.Itoa(int(b)))
+	}
+}
+
+// isSystemHeader reports whether a file was found in a system include
+// directory or is a built-in header.
+func (pp *Preprocessor) isSystemHeader(file string) bool {
+	dirs := append(append([]string{}, pp.SystemIncludePaths...), BuiltinIncludeDir)
+	dirs = append(dirs, defaultSystemIncludePaths...)
+	for _, dir := range dirs {
+		if strings.HasPrefix(filepath.Clean(file), filepath.Clean(dir)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
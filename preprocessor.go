@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxIncludeDepth is the default limit on nested #include, as in gcc.
+const DefaultMaxIncludeDepth = 200
+
+var defaultSystemIncludePaths = []string{
+	"/usr/local/include",
+	"/usr/include/x86_64-linux-gnu",
+	"/usr/include",
+}
+
+const (
+	IN_THEN = iota
+	IN_ELIF
+	IN_ELSE
+)
+
+// conditional is an open #if, #ifdef or #ifndef. Included records whether
+// one of its groups has been taken.
+type conditional struct {
+	Directive *Token
+	Context   int
+	Included  bool
+}
+
+// sourceFile is an entry of the include stack.
+type sourceFile struct {
+	Name         string
+	Path         string
+	lexer        *Lexer
+	file         io.ReadCloser
+	peeked       *Token
+	conditionals []*conditional
+	guardState   int
+	guard        string // the macro of the include guard
+	guardDepth   int    // the index of its conditional
+}
+
+func (f *sourceFile) next() *Token {
+	if token := f.peeked; token != nil {
+		f.peeked = nil
+		return token
+	}
+	return f.lexer.Next()
+}
+
+func (f *sourceFile) unread(token *Token) {
+	f.peeked = token
+}
+
+// Preprocessor executes preprocessing directives and expands macros while
+// pulling tokens from the lexers of the files on its include stack. Tokens
+// keep the spans given by the lexer of the file they were read from; tokens
+// produced by a macro expansion take the span of the macro invocation.
+type Preprocessor struct {
+	IncludePaths       []string
+	SystemIncludePaths []string
+	MaxIncludeDepth    int
+	Macros             map[string]*Macro
+	// Time is the time of translation given by __DATE__ and __TIME__.
+	Time        time.Time
+	Diagnostics []Diagnostic
+	files       []*sourceFile
+	pending     []*Token // tokens to rescan, in reverse order
+	counter     int      // the next value of __COUNTER__
+	mainFile    string
+	markers     []lineMarker
+	pragmas     map[string]PragmaHandler
+	// onceFiles and includeGuards are the paths of files that need not be
+	// read again, and the guard macros of the latter.
+	onceFiles     map[string]bool
+	includeGuards map[string]string
+	pack          int
+	packStack     []packEntry
+	produced      int // the number of tokens returned by Next
+	eof           *Token
+}
+
+func NewPreprocessor() *Preprocessor {
+	pp := &Preprocessor{
+		MaxIncludeDepth: DefaultMaxIncludeDepth,
+		Macros:          map[string]*Macro{},
+		Time:            time.Now(),
+		pragmas:         map[string]PragmaHandler{},
+		onceFiles:       map[string]bool{},
+		includeGuards:   map[string]string{},
+	}
+	pp.definePredefinedMacros()
+	pp.registerBuiltinPragmas()
+	return pp
+}
+
+// Start begins preprocessing the named file, whose tokens are then read
+// with Next. The diagnostics of the preprocessor and of the lexers of every
+// file it reads are collected in Diagnostics.
+func (pp *Preprocessor) Start(name string) {
+	pp.mainFile = name
+	if !pp.pushFile(name, Span{File: name}) {
+		pp.eof = &Token{Span: Span{File: name}, Type: TK_EOF, Value: "EOF"}
+	}
+}
+
+// Next returns the next token after preprocessing. Once the main file is
+// exhausted it returns its TK_EOF token on every call.
+func (pp *Preprocessor) Next() *Token {
+	for {
+		token := pp.read()
+		if !pp.expand(token) {
+			pp.produced++
+			return token
+		}
+	}
+}
+
+// read returns the next token to rescan, or else the next token of the
+// innermost file after executing any directives.
+func (pp *Preprocessor) read() *Token {
+	if n := len(pp.pending); n > 0 {
+		token := pp.pending[n-1]
+		pp.pending = pp.pending[:n-1]
+		return token
+	}
+	for {
+		if len(pp.files) == 0 {
+			return pp.eof
+		}
+		file := pp.files[len(pp.files)-1]
+		token := file.next()
+		if token.Type == TK_EOF {
+			for _, cond := range file.conditionals {
+				pp.errorAt(cond.Directive.Span, "unterminated #%s", cond.Directive.Value)
+			}
+			pp.popFile()
+			if len(pp.files) == 0 {
+				pp.eof = token
+			}
+			continue
+		}
+		if token.Type == '#' && token.AtBOL {
+			pp.directive(file)
+			if len(pp.pending) > 0 {
+				// the directive produced tokens, such as a #pragma
+				return pp.read()
+			}
+			continue
+		}
+		file.noteContent()
+		return token
+	}
+}
+
+// unreadTokens pushes tokens back so that they are read again in order.
+func (pp *Preprocessor) unreadTokens(tokens []*Token) {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		pp.pending = append(pp.pending, tokens[i])
+	}
+}
+
+func (pp *Preprocessor) directive(file *sourceFile) {
+	name := file.next()
+	if name.AtBOL || name.Type == TK_EOF {
+		// the null directive
+		file.unread(name)
+		return
+	}
+	if name.Value != "ifndef" {
+		file.noteContent()
+	}
+	pp.execute(file, name)
+}
+
+func (pp *Preprocessor) execute(file *sourceFile, name *Token) {
+	if name.Type == TK_NUMBER {
+		// a GNU linemarker "# 12 "file.c" flags", as in the output of -E
+		pp.line(file, name, append([]*Token{name}, pp.readLine(file)...))
+		return
+	}
+	switch name.Value {
+	case "include":
+		pp.include(file, name)
+	case "embed":
+		pp.embed(file, name)
+	case "define":
+		pp.define(file, name)
+	case "undef":
+		pp.undef(file, name)
+	case "if":
+		pp.beginConditional(file, name, pp.condition(file, name))
+	case "ifdef", "ifndef":
+		macro := pp.macroOperand(file, name)
+		if name.Value == "ifndef" && macro != nil && file.guardState == GUARD_START {
+			file.guardState = GUARD_INSIDE
+			file.guard = macro.Value
+			file.guardDepth = len(file.conditionals)
+		} else if name.Value == "ifndef" {
+			file.noteContent()
+		}
+		pp.beginConditional(file, name, macro != nil && pp.isDefined(macro.Value) == (name.Value == "ifdef"))
+	case "elif":
+		pp.elif(file, name)
+	case "else":
+		pp.elseGroup(file, name)
+	case "endif":
+		pp.endif(file, name)
+	case "line":
+		pp.line(file, name, pp.expandTokens(pp.readLine(file)))
+	case "pragma":
+		pp.pragma(file, name)
+	case "error":
+		pp.errorAt(name.Span, "#error%s", lineText(pp.readLine(file)))
+	case "warning":
+		pp.warningAt(name.Span, "#warning%s", lineText(pp.readLine(file)))
+	default:
+		pp.errorAt(name.Span, "invalid preprocessing directive #%s", name.Value)
+		pp.readLine(file)
+	}
+}
+
+func (pp *Preprocessor) include(file *sourceFile, directive *Token) {
+	token := file.lexer.NextHeaderName()
+	if token.AtBOL || token.Type == TK_EOF {
+		file.unread(token)
+		pp.errorAt(directive.Span, "#include expects \"FILENAME\" or <FILENAME>")
+		return
+	}
+	rest := pp.readLine(file)
+	if token.Type != TK_HEADER_NAME {
+		// a computed include: the macro-expanded line must begin with
+		// "..." or <...>
+		header, after, ok := headerName(pp.expandTokens(append([]*Token{token}, rest...)))
+		if !ok {
+			at := directive.Span
+			if header != nil {
+				at = header.Span
+			}
+			pp.errorAt(at, "#include expects \"FILENAME\" or <FILENAME>")
+			return
+		}
+		token, rest = header, after
+	}
+	if len(rest) > 0 {
+		pp.warningAt(rest[0].Span, "extra tokens at end of #include directive")
+	}
+	header := token.Value[1 : len(token.Value)-1]
+	path, ok := pp.findInclude(header, token.Value[0] == '"', file)
+	if !ok {
+		pp.errorAt(token.Span, "%s: No such file or directory", header)
+		return
+	}
+	if pp.skipsInclude(absPath(path)) {
+		return
+	}
+	pp.pushFile(path, token.Span)
+}
+
+// headerName forms a header name from the first tokens of a macro-expanded
+// line, which are a string literal or the tokens from '<' to '>' spelled
+// with a space wherever they had whitespace in between. It returns the
+// header name and the tokens after it, or else the offending token, which
+// is nil if the line expands to nothing.
+func headerName(line []*Token) (*Token, []*Token, bool) {
+	if len(line) == 0 {
+		return nil, nil, false
+	}
+	first := line[0]
+	if first.Type == TK_STRING && first.Encoding == ENC_NONE {
+		return &Token{Span: first.Span, Type: TK_HEADER_NAME, Value: first.Spelling, Spelling: first.Spelling}, line[1:], true
+	}
+	if first.Type != '<' {
+		return first, nil, false
+	}
+	var b strings.Builder
+	b.WriteString("<")
+	for i, t := range line[1:] {
+		if t.Type == '>' {
+			b.WriteString(">")
+			span := first.Span
+			span.EndOffset, span.EndLine, span.EndColumn = t.EndOffset, t.EndLine, t.EndColumn
+			return &Token{Span: span, Type: TK_HEADER_NAME, Value: b.String(), Spelling: b.String()}, line[i+2:], true
+		}
+		if i > 0 && t.HasSpace {
+			b.WriteString(" ")
+		}
+		b.WriteString(t.Spelling)
+	}
+	return first, nil, false
+}
+
+// line executes #line, which sets the line number of the next source line
+// and optionally the presumed file name reported for the tokens that follow.
+func (pp *Preprocessor) line(file *sourceFile, directive *Token, line []*Token) {
+	if len(line) == 0 {
+		pp.errorAt(directive.Span, "unexpected end of file after #line")
+		return
+	}
+	number, err := strconv.ParseUint(line[0].Value, 10, 32)
+	if line[0].Type != TK_NUMBER || err != nil || strings.Trim(line[0].Value, "0123456789") != "" {
+		pp.errorAt(line[0].Span, "\"%s\" after #line is not a positive integer", line[0].Spelling)
+		return
+	}
+	if number > math.MaxInt32 {
+		pp.warningAt(line[0].Span, "line number out of range")
+	}
+	name := file.lexer.File
+	if len(line) > 1 {
+		if line[1].Type != TK_STRING || line[1].Encoding != ENC_NONE {
+			pp.errorAt(line[1].Span, "invalid filename \"%s\"", line[1].Spelling)
+			return
+		}
+		name = line[1].Value
+		if len(line) > 2 && directive.Type != TK_NUMBER {
+			pp.warningAt(line[2].Span, "extra tokens at end of #line directive")
+		}
+	}
+	// The next line follows the one the directive ends on. Its first token
+	// has already been read, so it is renumbered too.
+	delta := int(number) - (line[len(line)-1].EndLine + 1)
+	file.lexer.File = name
+	file.lexer.Line += delta
+	if next := file.peeked; next != nil {
+		next.File = name
+		next.Line += delta
+		next.EndLine += delta
+	}
+	pp.markers = append(pp.markers, lineMarker{Index: pp.produced, File: name, Line: int(number)})
+}
+
+// findInclude searches for a header. Quoted names are looked up in the
+// directory of the including file first; both forms then search -I, then
+// -isystem, the built-in headers and finally the default system directories.
+func (pp *Preprocessor) findInclude(header string, quoted bool, from *sourceFile) (string, bool) {
+	if filepath.IsAbs(header) {
+		return header, headerExists(header)
+	}
+	dirs := []string{}
+	if quoted {
+		dirs = append(dirs, filepath.Dir(from.Name))
+	}
+	dirs = append(dirs, pp.IncludePaths...)
+	dirs = append(dirs, pp.SystemIncludePaths...)
+	dirs = append(dirs, BuiltinIncludeDir)
+	dirs = append(dirs, defaultSystemIncludePaths...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, header)
+		if headerExists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// absPath returns the path that identifies a file on the include stack.
+func absPath(name string) string {
+	path, err := filepath.Abs(name)
+	if err != nil || isBuiltinHeader(name) {
+		return filepath.Clean(name)
+	}
+	return path
+}
+
+// pushFile opens a file and makes it the innermost file of the include
+// stack. at is where the inclusion was requested, for diagnostics.
+func (pp *Preprocessor) pushFile(name string, at Span) bool {
+	path := absPath(name)
+	if len(pp.files) > pp.MaxIncludeDepth {
+		// A file may include itself when guarded by a conditional, so a
+		// cycle is only diagnosed when it never terminates.
+		for i := len(pp.files) - 1; i >= 0; i-- {
+			if pp.files[i].Path == path {
+				chain := []string{}
+				for _, g := range pp.files[i:] {
+					chain = append(chain, g.Name)
+				}
+				chain = append(chain, name)
+				pp.errorAt(at, "#include cycle: %s", strings.Join(chain, " -> "))
+				return false
+			}
+		}
+		pp.errorAt(at, "#include nested depth %d exceeds maximum of %d", len(pp.files), pp.MaxIncludeDepth)
+		return false
+	}
+	f, err := openHeader(name)
+	if err != nil {
+		pp.errorAt(at, "%s", err)
+		return false
+	}
+	if len(pp.files) > 0 {
+		pp.markers = append(pp.markers, lineMarker{Index: pp.produced, File: name, Line: 1, Flag: MARKER_ENTER})
+	}
+	pp.files = append(pp.files, &sourceFile{
+		Name:  name,
+		Path:  path,
+		lexer: NewReaderLexer(name, f),
+		file:  f,
+	})
+	return true
+}
+
+func (pp *Preprocessor) popFile() {
+	file := pp.files[len(pp.files)-1]
+	pp.files = pp.files[:len(pp.files)-1]
+	pp.Diagnostics = append(pp.Diagnostics, file.lexer.Diagnostics...)
+	file.file.Close()
+	if file.guardState == GUARD_END {
+		pp.includeGuards[file.Path] = file.guard
+	}
+	if len(pp.files) > 0 {
+		parent := pp.files[len(pp.files)-1]
+		line := parent.lexer.Line
+		if parent.peeked != nil {
+			line = parent.peeked.Line
+		}
+		pp.markers = append(pp.markers, lineMarker{Index: pp.produced, File: parent.lexer.File, Line: line, Flag: MARKER_RETURN})
+	}
+}
+
+// readLine returns the remaining tokens of the current directive line.
+func (pp *Preprocessor) readLine(file *sourceFile) []*Token {
+	tokens := []*Token{}
+	for {
+		token := file.next()
+		if token.AtBOL || token.Type == TK_EOF {
+			file.unread(token)
+			return tokens
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func (pp *Preprocessor) errorAt(span Span, format string, args ...interface{}) {
+	pp.report(span, DIAG_ERROR, format, args...)
+}
+
+// errorAtToken reports an error at a token with the expansion history of
+// the token.
+func (pp *Preprocessor) errorAtToken(t *Token, format string, args ...interface{}) {
+	pp.Diagnostics = append(pp.Diagnostics, tokenDiagnostic(t, DIAG_ERROR, fmt.Sprintf(format, args...)))
+}
+
+func (pp *Preprocessor) warningAt(span Span, format string, args ...interface{}) {
+	pp.report(span, DIAG_WARNING, format, args...)
+}
+
+func (pp *Preprocessor) report(span Span, severity int, format string, args ...interface{}) {
+	pp.Diagnostics = append(pp.Diagnostics, Diagnostic{
+		Span:     span,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
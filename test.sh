@@ -36,6 +36,20 @@ test_g() {
     fi
 }
 
+test_error() {
+    expected=$1
+    input=$2
+    echo "$input" > ./tmp/tmp.c
+    actual=$(./mycc ./tmp/tmp.c 2>&1 > /dev/null)
+
+    if [[ "$?" != 0 && "$actual" == *"$expected"* ]]; then
+        echo "$input => $expected"
+    else
+        echo "error \"$expected\" expected, but got \"$actual\""
+        exit 1
+    fi
+}
+
 #test 3 "a = 3;"
 #test 8 "a = 1 + 3 + 4;"
 #test 7 "a = 1 + 10 - 4;"
@@ -85,6 +99,239 @@ test_g 2 "int a; int main() { int a = 2; return a; }"
 test_g 3 "int a = 3; int main() { return a; }"
 test 97 "char a = 'a'; return a;"
 test 3 "char x[3]; x[0] = -1; x[1] = 2; int y; y = 4; return x[0] + y;"
-test 3 "char *x = \"234\"; int y; y = 4; return x[0] + y;"
+test 54 "char *x = \"234\"; int y; y = 4; return x[0] + y;"
+test_g 3 "int main() { /* block
+ comment */ return 3; } // line comment"
+test 31 "return 0x1F;"
+test 15 "return 017;"
+test 5 "return 0b101;"
+test 4 "return sizeof(0xFFFFFFFF);"
+test 8 "return sizeof(2147483648);"
+test 8 "return sizeof(1ul);"
+test 15 "return 0xFFFFFFFFFFFFFFFF - 0xFFFFFFFFFFFFFFF0;"
+test 10 "return '\\n';"
+test 65 "return '\\x41';"
+test 65 "return '\\101';"
+test 34 "char *x = \"a\\\"b\\\\\"; return x[1];"
+test 92 "char *x = \"a\\\"b\\\\\"; return x[3];"
+test 97 "char *x = \"\\0a\"; return x[1];"
+test 9 "int my_var = 3; int _b2 = 6; return my_var + _b2;"
+test_g 5 "int __x = 5; int main() { return __x; }"
+test 100 "char *s = \"ab\" \"cd\"; return s[3];"
+test 99 "int *s = L\"ab\" \"cd\"; return s[2];"
+test 4 "return sizeof('a');"
+test 98 "return L'b';"
+test_g 7 "#define N 3
+int main() { return N + 4; }"
+test_g 6 "#define add(a, b) a + b
+int main() { return add(1, add(2, 3)); }"
+test_g 43 "#define str(x) #x
+int main() { char *s = str(a  +  b); return s[2]; }"
+test_g 32 "#define str(x) #x
+int main() { char *s = str(a
+b); return s[1]; }"
+test_g 7 "#define cat(a, b) a##b
+int main() { int xy = 7; return cat(x, y); }"
+test_g 9 "#define first(x, ...) x
+#define rest(x, ...) __VA_ARGS__
+int main() { return first(4, 5, 6) + rest(4, 5); }"
+test_g 3 "int g = 2;
+#define g g + 1
+int main() { return g; }"
+test_g 1 "#define V 2
+#if V * 2 == 4 && defined(V)
+int main() { return 1; }
+#elif 1
+int main() { return 2; }
+#endif"
+test_g 3 "#ifdef NOPE
+int main() { return 1; }
+#else
+int main() { return 3; }
+#endif"
+test_g 2 "#if 0
+#if 1
+int main() { return 1; }
+#endif
+#elif (-1 > 0u) || 1 / 0
+int main() { return 2; }
+#else
+int main() { return 4; }
+#endif"
+test_g 3 "#if -1 < 0xFFFFFFFF && 0x80000000 > -1 && -1 > 0xFFFFFFFFu && -1 == 0xFFFFFFFFFFFFFFFF
+int main() { return 3; }
+#endif"
+test_g 3 "#if __STDC_VERSION__ >= 201112L && defined(__x86_64__)
+int main() { return __LINE__ + __COUNTER__ + __COUNTER__; }
+#endif"
+test_g 40 "#line 40
+int main() { return __LINE__; }"
+test_g 9 "#include <limits.h>
+#include <stdbool.h>
+#include <float.h>
+#if INT_MAX == 2147483647 && __has_include(<stdint.h>)
+int main() { return CHAR_BIT + true; }
+#endif"
+test_g 48 "#include <stddef.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdalign.h>
+#include <stdnoreturn.h>
+#include <limits.h>
+#include <float.h>
+uint8_t g = 300;
+int64_t big = INT64_MAX;
+int main() { size_t n = 3; uint16_t s = 65535; s++; int16_t t = 32767; t++; unsigned long long u = UINT64_MAX; return g + s + (t < 0) + (big > 0) + (u > 0) + (NULL == 0); }"
+test_g 31 "#include <limits.h>
+int a = -1; int b = 1 + 2; int m = INT_MIN; unsigned char c = -1; long l = (1 ? 5 : 0) * 2;
+int main() { return (a == -1) + 2 * (b == 3) + 4 * (m == -2147483647 - 1) + 8 * (c == 255) + 16 * (l == 10); }"
+test_error "tmp.c:1:20: error: initializer element is not constant" "int g = 1; int h = g + 1;"
+test_g 63 "#include <stdarg.h>
+#include <stdalign.h>
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdnoreturn.h>
+#include <limits.h>
+#include <float.h>
+alignas(16) char buffer[3];
+bool ready = 2;
+noreturn int halt() { while (true); }
+int main() { alignas(int64_t) char c = CHAR_MAX; bool b = ready + 1; size_t n = alignof(uint32_t); long at = &c; b--; return (b == false) + 2 * (ready == 1) + 4 * (n == 4) + 8 * (at % 8 == 0) + 16 * (FLT_RADIX == 2) + 32 * (c == 127 && NULL == 0); }"
+test_error "'_Noreturn' can only appear on functions" "_Noreturn int g;"
+test_error "requested alignment is less than minimum alignment of 4 for type" "_Alignas(2) int g;"
+test 5 "int x = 5; int a[4]; a[0] = 1; a[1] = 2; a[2] = 3; a[3] = 4; return x;"
+test_g 6 "typedef long unsigned word;
+typedef word *wordp;
+int main() { word w = 6; wordp p = &w; short signed int s = -1; return *p + (s == -1) - 1; }"
+test_error "'signed' and 'unsigned' cannot be combined" "int main() { signed unsigned x = 1; return x; }"
+test_error "'long long long' is too long" "long long long x;"
+test_g 5 "#pragma pack(push, 1)
+int main() {
+#pragma pack(pop)
+  return 5;
+}
+#pragma unknown"
+test 7 "int x = 2; if (x)
+#pragma foo
+x = x +
+#pragma unknown
+5; return x;"
+
+test_g 13 "char d[] = {
+#embed \"tmp.c\" limit(4) prefix(1, ) suffix(, 0)
+};
+char e[] = {
+#embed \"tmp.c\" __limit__(0) if_empty(7)
+};
+int main() { return d[2] - 'a' + sizeof(d) + e[0] - 7; }"
+
+test_g 7 "int g;
+int main() { int a[2]; int *p = &g; *p = 3; a[1] = g = g + 1; p = &a[1]; return -a[0 + 1] + 11 + sizeof(a[1]) - *p; }"
+test_error "tmp.c:1:26: error: expected ';' after expression" "int main() { int x; x = 1
+  return x
+}"
+test 5 "int x = 0; ; while (x < 5 && ++x); if (x) ; else ; for (;;) { ; break; } return x;"
+test_error "tmp.c:3:3: error: use of undeclared identifier 'y'" "int main() {
+  1 + ;
+  y = 2;
+}"
+
+test 7 "return 10 - 1 - 2;"
+test 2 "return 1 - 2 + 3;"
+test 2 "return 100 / 10 / 5;"
+test 2 "return 100 % 7 % 3;"
+test 14 "return 2 + 3 * 4;"
+test 6 "return -2 * -3;"
+test 1 "return ~0 + 2;"
+test 4 "return 1 << 1 + 1;"
+test 8 "return 64 >> 2 >> 1;"
+test 1 "return 1 << 2 < 5;"
+test 0 "return 3 > 2 > 1;"
+test 1 "return 1 < 2 == 1;"
+test 1 "return 1 == 2 == 0;"
+test 0 "return 2 & 2 == 2;"
+test 3 "return 3 ^ 1 & 0;"
+test 6 "return 6 | 5 ^ 5;"
+test 1 "return 1 || 0 && 0;"
+test 10 "return 0 && 0 | 1 ? 20 : 10;"
+test 3 "return 0 ? 1 : 0 ? 2 : 3;"
+test 10 "int a; int b; a = b = 5; return a + b;"
+test 3 "int a; int b; a = (b = 1, 2); return a + b;"
+test 7 "int a = 10; a -= 3; a *= 2; a /= 7; a += 5; a %= 4; a <<= 3; a >>= 1; a |= 1; a &= 7; a ^= 2; return a;"
+test 21 "int x = 5; int y = x++ + 10; return y + x;"
+test 9 "int a[2]; a[0] = 3; a[1] = 5; int *p = a; p++; return *p + sizeof a[0];"
+test 0 "int a = 0; 0 && (a = 1); 1 || (a = 2); return a;"
+
+test 20 "int x = 2; if (x == 1) return 10; else if (x == 2) return 20; else return 30;"
+test 30 "int x = 5; if (x == 1) return 10; else if (x == 2) return 20; else return 30;"
+test 60 "int r = 0; int x; for (x = 1; x < 6; x = x + 1) { if (x == 1) r = r + 10; else if (x == 2) r = r + 20; else { if (x == 3) if (x == 4) r = r + 40; else r = r + 30; } } return r;"
+
+test 7 "int i = 0; for (;;) { i++; if (i == 7) break; } return i;"
+test 20 "int s = 0; int i; for (i = 0; i < 10; i++) { if (i % 2) continue; s += i; } return s;"
+test 6 "int s = 0; for (int i = 0; i < 4;) { s += i; i++; } return s;"
+test 12 "int i = 0; int n = 0; do { i++; if (i == 3) continue; n += i; } while (i < 5); return n;"
+test 10 "int i = 9; do i++; while (0); return i;"
+test 3 "int i = 0; int j = 0; while (i < 10) { i++; do { j++; break; } while (1); if (j == 3) break; } return i;"
+test_error "expected 'while' in do/while loop" "int main() { do { } return 0; }"
+
+test 23 "int x = 2; int r = 0; switch (x) { case 1: r = 10; break; case 2: r = 20; case 3: r += 3; break; default: r = 99; } return r;"
+test 7 "int r = 5; switch (3) { } switch (1) { default: r = 7; } return r;"
+test 119 "int s = 0; int i; for (i = 0; i < 12; i++) { switch (i) { case 0: s += 1; break; case 1: s += 2; break; case 2: s += 4; break; case 4: s += 8; break; case 5: s += 16; break; case 7: continue; default: s += 100; } } return s % 256;"
+test 127 "int s = 0; int i; for (i = -5; i < 1100; i++) { switch (i) { case -3: s += 1; break; case 10: s += 2; break; case 100: s += 4; break; case 400: s += 8; break; case 700: s += 16; break; case 1000: s += 32; break; case 1099: s += 64; } } return s;"
+test 5 "int r = 0; switch (2) { case 1: case 2: switch (r) { case 0: r = 4; break; } r += 1; break; } return r;"
+test 3 "switch (1 << 2) { case 2 * 2: return 3; case ~0: return 4; } return 0;"
+test_error "duplicate case value '3'" "int main() { switch (1) { case 3: case 1 + 2: return 0; } return 1; }"
+test_error "multiple default labels in one switch" "int main() { switch (1) { default: default: return 0; } return 1; }"
+test_error "'case' statement not in switch statement" "int main() { case 1: return 0; }"
+test_error "expression is not an integer constant expression" "int main() { int x = 1; switch (x) { case x: return 0; } return 1; }"
+
+test 10 "int i = 0; int s = 0; loop: if (i >= 5) goto done; s += i; i++; goto loop; done: return s;"
+test 1 "int i = 0; goto skip; i = 50; skip: { i++; goto out; } i = 99; out: return i;"
+test 14 "int i; int j; int n = 0; for (i = 0; i < 5; i++) for (j = 0; j < 5; j++) { n++; if (i * j == 6) goto found; } found: return n;"
+test_error "use of undeclared label 'nowhere'" "int main() { goto nowhere; return 0; }"
+test_error "redefinition of label 'a'" "int main() { a: goto a; a: return 0; }"
+test_error "warning: unused label 'unused'" "int main() { unused: return x; }"
+
+test 30 "return (-1 < 1u) + 2 * (-1 == 4294967295u) + 4 * (1 < 2) + 8 * (-1 < 1) + 16 * (3000000000u > 5);"
+test 15 "char c = -1; return (c < 0) + 2 * (c <= 255) + 4 * (c >= -1) + 8 * (c > -2);"
+test 7 "int a[2]; int *p = &a[0]; int *q = &a[1]; return (q > p) + 2 * (p <= q) + 4 * (p == a);"
+test 13 "int a = 0; return !a + 2 * !5 + 4 * !!7 + 8 * (!0 == 1);"
+test 42 "int a = 0; int b = 0; a++ && b++; a++ || b++; 0 || (b = b + 10); return a * 16 + b;"
+test 2 "switch (0) { case !1: return 2; } return 0;"
+
+test 15 "return 0xFFFFFFFFFFFFFFFF >> 60;"
+test 15 "return 0xFFFFFFFFFFFFFFFF / 0x1000000000000000;"
+test 31 "unsigned x = 4294967295u; x /= 2; return (x == 2147483647) + 2 * (4294967295u % 10 == 5) + 4 * ((-8 >> 1) == -4) + 8 * (-7 / 2 == -3) + 16 * (-7 % 2 == -1);"
+
+test_error "'break' statement not in loop or switch statement" "int main() { break; }"
+test_error "'continue' statement not in loop statement" "int main() { continue; }"
+test_error "'continue' statement not in loop statement" "int main() { switch (1) { case 1: continue; } return 0; }"
+test 4 "int i; int n = 0; for (i = 0; i < 4; i++) switch (i) { case 1: continue; default: n++; } return n + 1;"
+
+test 7 "int r = 0; switch (1) { case 1 < 2 && 3 >= 3: r += 1; case 1 ? 2 : 3: r += 2; case (-1 > 0u) + 2: r += 4; } return r;"
+test 3 "switch (4294967295u) { case -1: return 3; } return 0;"
+test 5 "switch (2147483647) { case 2147483647 + 1: return 4; case (2147483647 + 1) - 1: return 5; } return 0;"
+test 6 "switch (15) { case 0xFFFFFFFFu >> 28: return 6; case 1 << 3 | 7 ^ 1 & 3: return 2; } return 0;"
+test_error "expression is not an integer constant expression" "int main() { switch (1) { case 1 / 0: return 0; } return 1; }"
+
+test 1 "return (1u * 3) < -1;"
+test 0 "return (2u / 1) > -1;"
+test 125 "unsigned u = 3; return ((1u * 3) < -1) + 2 * ((2u / 1) > -1) + 4 * ((u & 7) < -1) + 8 * ((u << 1) > -1 == 0) + 16 * (-u > 0) + 32 * (~0u > 0) + 64 * ((1 ? u : 0) < -1);"
+test 31 "long l = -1; unsigned u = 1; char c = -1; unsigned char uc = 255; return (l < u) + 2 * (c < uc) + 4 * ((u % 2 ^ 0u) < -1) + 8 * ((u - 2) / 2 > 1000) + 16 * ((c >> 1) == -1);"
+test 3 "unsigned u = 4294967295u; switch (u * 1) { case -1: return 3; } return 0;"
+test_g 44 "#define SYSTEM <stdint.h>
+#define QUOTED(name) #name
+#include SYSTEM
+#include QUOTED(stddef.h)
+int main() { int8_t c = 300; size_t s = c; return s; }"
+test_error "#include expects" "#define EMPTY
+#include EMPTY"
+test 31 "char c; unsigned char u = 255; short s; unsigned x; return ((c = 300) == 44) + 2 * ((u += 1) == 0) + 4 * ((s = 65535) == -1) + 8 * ((x = -1) == 4294967295) + 16 * ((c = 200) < 0);"
+test 186 "char c = 1; long l; int x = 0; int a[3]; return sizeof(~c) + 10 * sizeof(x ? c : l) + 100 * (sizeof(c++) == 1) + 2 * (sizeof(c += 1) == 1) + (sizeof(&x) == 8) + (sizeof(c = 5) == 1) + (sizeof -c == 4) + (sizeof(*&a) == 12) + (c == 1) - 5;"
+test 7 "unsigned u = 4294967295u; int i = 2147483647; int s = 0; switch (u + 1) { case 0: s += 1; } switch (u + 2) { case 1: s += 2; break; case 2: case 3: case 5: case 6: break; } switch (i + 1) { case -2147483647 - 1: s += 4; break; case 10: case 300: case 5000: case 70000: break; } return s;"
+test 63 "unsigned u = 0; long l = u - 1; unsigned v = 4294967295u; int i = -1; int c = 1; return (l == 4294967295) + 2 * ((v + 1) + 0L == 0) + 4 * ((c ? i : v) + 0L == 4294967295) + 8 * (~v + 0L == 0) + 16 * (v * 2 + 0L == 4294967294) + 32 * ((i - 1) + 0L == -2);"
+test 127 "int a[4]; int *p = a; int *q = p + 1; a[0] = 1; a[1] = 2; a[2] = 3; a[3] = 4; char s[3]; char *t = s + 2; return (q - p == 1) + 2 * (*(a + 1 + 1) == 3) + 4 * (*(1 + p + 2) == 4) + 8 * (p - q == -1) + 16 * (*(q - 1) == 1) + 32 * (t - s == 2) + 64 * (*(&a[1] + 1) == 3);"
 
 echo OK